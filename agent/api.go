@@ -10,7 +10,7 @@ import (
 type APIClient interface {
 	AcceptJob(*api.Job) (*api.Job, *api.Response, error)
 	AcquireJob(string) (*api.Job, *api.Response, error)
-	Annotate(string, *api.Annotation) (*api.Response, error)
+	Annotate(string, *api.Annotation) (*api.AnnotationResponse, *api.Response, error)
 	AnnotationRemove(string, string) (*api.Response, error)
 	Config() api.Config
 	Connect() (*api.Response, error)
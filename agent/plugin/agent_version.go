@@ -0,0 +1,125 @@
+package plugin
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// RequiredAgentVersionKey is a reserved configuration key holding the agent
+// versions a plugin works with, e.g. {"_requires": ">=3.40"}
+const RequiredAgentVersionKey = "_requires"
+
+var versionConstraintRegex = regexp.MustCompile(`^(>=|<=|!=|>|<|=)?\s*v?(\d+(?:\.\d+){0,2})$`)
+
+// versionConstraint is a comparison against a version, like >=3.40
+type versionConstraint struct {
+	operator string
+	version  []int
+}
+
+// parseVersionConstraints parses comma separated constraints that must all be
+// satisfied, like ">=3.40, <4". Versions have up to three numeric parts, and
+// missing parts are zero. A constraint without an operator is an exact match.
+func parseVersionConstraints(s string) ([]versionConstraint, error) {
+	var constraints []versionConstraint
+
+	for _, part := range strings.Split(s, ",") {
+		matches := versionConstraintRegex.FindStringSubmatch(strings.TrimSpace(part))
+		if matches == nil {
+			return nil, fmt.Errorf("Invalid agent version constraint %q, expected something like >=3.40", s)
+		}
+
+		version, err := parseVersion(matches[2])
+		if err != nil {
+			return nil, err
+		}
+
+		constraints = append(constraints, versionConstraint{operator: matches[1], version: version})
+	}
+
+	return constraints, nil
+}
+
+// parseVersion parses the numeric parts of a version like v3.40.1. Anything
+// after the numbers, like a prerelease or build suffix, is ignored.
+func parseVersion(s string) ([]int, error) {
+	numbers := strings.TrimPrefix(strings.TrimSpace(s), "v")
+	if i := strings.IndexAny(numbers, "-+ "); i >= 0 {
+		numbers = numbers[:i]
+	}
+
+	parts := strings.Split(numbers, ".")
+	if len(parts) > 3 {
+		return nil, fmt.Errorf("Invalid version %q", s)
+	}
+
+	version := make([]int, 3)
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("Invalid version %q", s)
+		}
+		version[i] = n
+	}
+
+	return version, nil
+}
+
+func compareVersions(a, b []int) int {
+	for i := range a {
+		if a[i] != b[i] {
+			if a[i] < b[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+func (c versionConstraint) satisfiedBy(version []int) bool {
+	cmp := compareVersions(version, c.version)
+
+	switch c.operator {
+	case ">=":
+		return cmp >= 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	case "<":
+		return cmp < 0
+	case "!=":
+		return cmp != 0
+	default:
+		return cmp == 0
+	}
+}
+
+// SatisfiesAgentVersion returns whether the given agent version meets the
+// plugin's RequiredAgentVersion, which every version does if it isn't set
+func (p *Plugin) SatisfiesAgentVersion(current string) (bool, error) {
+	if p.RequiredAgentVersion == "" {
+		return true, nil
+	}
+
+	constraints, err := parseVersionConstraints(p.RequiredAgentVersion)
+	if err != nil {
+		return false, err
+	}
+
+	version, err := parseVersion(current)
+	if err != nil {
+		return false, err
+	}
+
+	for _, c := range constraints {
+		if !c.satisfiedBy(version) {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
@@ -0,0 +1,74 @@
+package plugin
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCreatePluginWithRequiredAgentVersion(t *testing.T) {
+	t.Parallel()
+
+	plugin, err := CreatePlugin("github.com/buildkite-plugins/docker-compose#v1.0", map[string]interface{}{
+		"_requires": ">=3.40",
+		"image":     "llamas",
+	})
+	if assert.NoError(t, err) {
+		assert.Equal(t, ">=3.40", plugin.RequiredAgentVersion)
+		assert.Equal(t, map[string]interface{}{"image": "llamas"}, plugin.Configuration)
+	}
+
+	_, err = CreatePlugin("github.com/buildkite-plugins/docker-compose#v1.0", map[string]interface{}{"_requires": 3})
+	assert.EqualError(t, err, "_requires must be a string")
+
+	_, err = CreatePlugin("github.com/buildkite-plugins/docker-compose#v1.0", map[string]interface{}{"_requires": "newish"})
+	assert.EqualError(t, err, `Invalid agent version constraint "newish", expected something like >=3.40`)
+}
+
+func TestSatisfiesAgentVersion(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		requires  string
+		current   string
+		satisfied bool
+	}{
+		{"", "3.0.0", true},
+		{">=3.40", "3.40.0", true},
+		{">=3.40", "3.41.2", true},
+		{">=3.40", "3.39.9", false},
+		{">=3.40", "3.40.0-beta.1", true},
+		{">3.40", "3.40.0", false},
+		{"<4", "3.99.1", true},
+		{"<4", "4.0.0", false},
+		{"<=3.40.1", "3.40.1", true},
+		{"3.40", "3.40.0", true},
+		{"=3.40", "3.41.0", false},
+		{"!=3.40.1", "3.40.1", false},
+		{">= v3.40, < 4", "v3.45.0", true},
+		{">= v3.40, < 4", "4.1.0", false},
+	} {
+		plugin := &Plugin{Location: "github.com/buildkite-plugins/docker-compose", RequiredAgentVersion: tc.requires}
+
+		satisfied, err := plugin.SatisfiesAgentVersion(tc.current)
+		if assert.NoError(t, err, "%s %s", tc.requires, tc.current) {
+			assert.Equal(t, tc.satisfied, satisfied, "%s %s", tc.requires, tc.current)
+		}
+	}
+}
+
+func TestSatisfiesAgentVersionWithMalformedVersions(t *testing.T) {
+	t.Parallel()
+
+	for _, requires := range []string{"latest", ">=", ">=3.40,", "~>3.40", ">=3.40.1.2"} {
+		plugin := &Plugin{Location: "github.com/buildkite-plugins/docker-compose", RequiredAgentVersion: requires}
+
+		_, err := plugin.SatisfiesAgentVersion("3.40.0")
+		assert.Error(t, err, requires)
+		assert.Error(t, plugin.Validate(), requires)
+	}
+
+	plugin := &Plugin{Location: "github.com/buildkite-plugins/docker-compose", RequiredAgentVersion: ">=3.40"}
+	_, err := plugin.SatisfiesAgentVersion("main")
+	assert.EqualError(t, err, `Invalid version "main"`)
+}
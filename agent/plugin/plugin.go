@@ -1,14 +1,26 @@
 package plugin
 
 import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
 	"regexp"
 	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/buildkite/agent/v3/env"
+	"github.com/buildkite/agent/v3/logger"
 )
 
 type Plugin struct {
@@ -16,51 +28,440 @@ type Plugin struct {
 	// a git repository)
 	Location string
 
-	// The version of the plugin that should be running
+	// The version of the plugin that should be running, which is any git
+	// ref including ones with slashes (e.g. feature/foo)
 	Version string
 
+	// Options that follow the version in the location's fragment, separated
+	// by semicolons (e.g. #v1.0;shallow;depth=1). Options without a value are
+	// set to an empty string.
+	Options map[string]string
+
 	// The clone method
 	Scheme string
 
 	// Any authentication attached to the repository
 	Authentication string
 
+	// The port of the repository's host if the location has one, e.g. 2222
+	// for ssh://git@git.example.com:2222/plugins.git. It's also kept with the
+	// host in Location.
+	Port string
+
 	// Whether the plugin refers to a vendored path
 	Vendored bool
 
 	// Configuration for the plugin
 	Configuration map[string]interface{}
+
+	// An expression that decides whether the plugin should run, see ShouldRun
+	Condition string
+
+	// The agent versions the plugin works with, see SatisfiesAgentVersion
+	RequiredAgentVersion string
+
+	// How many commits to clone the plugin's repository with, like git clone
+	// --depth, where 0 is a full clone
+	CheckoutDepth int
+
+	// The values of secrets that were resolved into the configuration, so
+	// that they can be redacted from output
+	Secrets []string
 }
 
+// Plugins is a list of plugins, in the order they were defined
+type Plugins []*Plugin
+
 var (
 	locationSchemeRegex = regexp.MustCompile(`^[a-z\+]+://`)
 	vendoredRegex       = regexp.MustCompile(`^\.`)
+	windowsDriveRegex   = regexp.MustCompile(`^/?[a-zA-Z]:[/\\]`)
+	portRegex           = regexp.MustCompile(`:\d*$`)
 )
 
+// ConfigFileKey is a reserved configuration key that references a JSON file
+// holding the plugin's configuration, e.g. {"_config_file": "docker.json"}.
+// The keys in the file are merged into the configuration, and keys set
+// alongside the reference take precedence over the ones in the file. The path
+// must be relative, and can't leave the directory it's relative to. Pipelines
+// can't use it, as their plugins are set up before the checkout.
+const ConfigFileKey = "_config_file"
+
+// ErrConfigFileWithoutBaseDir is returned for configuration file references
+// when plugins are created without a base directory to read them from
+var ErrConfigFileWithoutBaseDir = fmt.Errorf("Can't read a %s without a base directory", ConfigFileKey)
+
+// ConditionKey is a reserved configuration key holding an expression that
+// decides whether the plugin should run, e.g. {"_if": "$DEPLOY == true"}
+const ConditionKey = "_if"
+
+// CheckoutDepthKey is a reserved configuration key holding how many commits to
+// clone the plugin's repository with, e.g. {"_checkout_depth": 1}. It can also
+// be given as a depth option in the location, e.g. #v1.0;depth=1.
+const CheckoutDepthKey = "_checkout_depth"
+
+// SecretKey is a reserved key for a configuration value that references a
+// secret, e.g. {"password": {"_secret": "registry-password"}}. The reference
+// is replaced with the secret's value when the plugin is created.
+const SecretKey = "_secret"
+
+// SecretProvider looks up secrets by name for configuration values that
+// reference them. It returns an error if the secret can't be found.
+type SecretProvider interface {
+	Secret(name string) (string, error)
+}
+
+// CreateOptions changes how CreatePluginWithOptions builds a plugin
+type CreateOptions struct {
+	// The directory that configuration file references are read relative
+	// to. Configuration file references are an error if this isn't set.
+	BaseDir string
+
+	// Lowercase every configuration key, which is an error if two keys in
+	// the same hash only differ by case
+	LowercaseKeys bool
+
+	// Limits on the size of the configuration
+	Limits ConfigLimits
+
+	// Where secrets referenced in the configuration are looked up. Secret
+	// references are an error if this isn't set.
+	Secrets SecretProvider
+}
+
 func CreatePlugin(location string, config map[string]interface{}) (*Plugin, error) {
-	plugin := &Plugin{Configuration: config}
+	return CreatePluginWithOptions(location, config, CreateOptions{})
+}
+
+// CreatePluginWithOptions is like CreatePlugin, but reads configuration file
+// references relative to opts.BaseDir
+func CreatePluginWithOptions(location string, config map[string]interface{}, opts CreateOptions) (*Plugin, error) {
+	config, err := loadConfigFile(config, opts.BaseDir)
+	if err != nil {
+		return nil, err
+	}
+
+	plugin := &Plugin{}
+
+	config, condition, hasCondition := popReservedKey(config, ConditionKey)
+	if hasCondition {
+		var ok bool
+		if plugin.Condition, ok = condition.(string); !ok {
+			return nil, fmt.Errorf("%s must be a string", ConditionKey)
+		}
+		if plugin.Condition != "" {
+			if _, err := parseCondition(plugin.Condition); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	config, requires, hasRequires := popReservedKey(config, RequiredAgentVersionKey)
+	if hasRequires {
+		var ok bool
+		if plugin.RequiredAgentVersion, ok = requires.(string); !ok {
+			return nil, fmt.Errorf("%s must be a string", RequiredAgentVersionKey)
+		}
+		if plugin.RequiredAgentVersion != "" {
+			if _, err := parseVersionConstraints(plugin.RequiredAgentVersion); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	config, depth, hasDepth := popReservedKey(config, CheckoutDepthKey)
+	if hasDepth {
+		if plugin.CheckoutDepth, err = parseCheckoutDepth(depth); err != nil {
+			return nil, fmt.Errorf("%s must be a number of commits that's 0 or more", CheckoutDepthKey)
+		}
+	}
+
+	resolved, err := resolveSecrets(config, opts.Secrets, &plugin.Secrets)
+	if err != nil {
+		return nil, err
+	}
+	config = resolved.(map[string]interface{})
+
+	if opts.LowercaseKeys {
+		lowercased, err := lowercaseConfigKeys(config)
+		if err != nil {
+			return nil, err
+		}
+		config = lowercased.(map[string]interface{})
+	}
 
-	u, err := url.Parse(location)
+	if err := opts.Limits.check(config); err != nil {
+		return nil, err
+	}
+
+	plugin.Configuration = config
+
+	// A Windows path with a drive letter would otherwise be parsed as a URL
+	// with the drive as its scheme, so it's treated as a file:// location,
+	// with forward slashes like file:///C:/plugins
+	parsed := location
+	if windowsDriveRegex.MatchString(parsed) {
+		parsed = "file:///" + strings.Replace(strings.TrimPrefix(parsed, "/"), "\\", "/", -1)
+	}
+
+	u, err := url.Parse(parsed)
 	if err != nil {
 		return nil, err
 	}
 
 	plugin.Scheme = u.Scheme
 	plugin.Location = u.Host + u.Path
-	plugin.Version = u.Fragment
+
+	// file:// locations are a path on this machine, where a host of
+	// localhost is the same as no host at all. Windows paths come through
+	// with a leading slash before the drive letter (file:///C:/plugins).
+	if u.Scheme == "file" && (u.Host == "" || u.Host == "localhost") {
+		plugin.Location = u.Path
+		if windowsDriveRegex.MatchString(plugin.Location) {
+			plugin.Location = strings.TrimPrefix(plugin.Location, "/")
+		}
+	}
+	plugin.Version, plugin.Options = parseFragment(u.Fragment)
 	plugin.Vendored = vendoredRegex.MatchString(plugin.Location)
 
-	if plugin.Version != "" && strings.Count(plugin.Version, "#") > 0 {
+	// Catch locations that can never be used now, rather than when they're
+	// checked out. Paths on this machine can be a single segment, and may
+	// use Windows backslashes.
+	if strings.TrimSpace(plugin.Location) == "" {
+		return nil, fmt.Errorf("Missing plugin location in \"%s\"", location)
+	}
+	if !plugin.Vendored && plugin.Scheme != "file" && !strings.Contains(plugin.Location, "/") {
+		return nil, fmt.Errorf("Incomplete plugin location \"%s\", expected a host and a path like github.com/my-org/my-plugin", location)
+	}
+
+	if strings.Count(u.Fragment, "#") > 0 {
 		return nil, fmt.Errorf("Too many #'s in \"%s\"", location)
 	}
 
+	if option, ok := plugin.Options["depth"]; ok {
+		optionDepth, err := parseCheckoutDepth(option)
+		if err != nil {
+			return nil, fmt.Errorf("The depth option in \"%s\" must be a number of commits that's 0 or more", location)
+		}
+		if hasDepth && optionDepth != plugin.CheckoutDepth {
+			return nil, fmt.Errorf("The checkout depth of \"%s\" is %d, but %s is %d", location, optionDepth, CheckoutDepthKey, plugin.CheckoutDepth)
+		}
+		plugin.CheckoutDepth = optionDepth
+	}
+
 	if u.User != nil {
 		plugin.Authentication = u.User.String()
 	}
 
+	if !plugin.IsLocal() {
+		plugin.Port = u.Port()
+	}
+
 	return plugin, nil
 }
 
+// loadConfigFile replaces a configuration file reference with the contents
+// of the file it points to
+func loadConfigFile(config map[string]interface{}, baseDir string) (map[string]interface{}, error) {
+	ref, ok := config[ConfigFileKey]
+	if !ok {
+		return config, nil
+	}
+
+	path, ok := ref.(string)
+	if !ok || path == "" {
+		return nil, fmt.Errorf("%s must be the path to a JSON file", ConfigFileKey)
+	}
+
+	if baseDir == "" {
+		return nil, ErrConfigFileWithoutBaseDir
+	}
+
+	// The reference comes from the pipeline, so it can only read files
+	// within the base directory
+	if filepath.IsAbs(path) {
+		return nil, fmt.Errorf("%s must be a path relative to the checkout, got %q", ConfigFileKey, path)
+	}
+
+	rel, err := filepath.Rel(baseDir, filepath.Join(baseDir, path))
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return nil, fmt.Errorf("%s must be a path within the checkout, got %q", ConfigFileKey, path)
+	}
+	path = filepath.Join(baseDir, rel)
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read plugin configuration file: %v", err)
+	}
+	defer f.Close()
+
+	// Use the same number decoding as CreateFromJSON
+	decoder := json.NewDecoder(f)
+	decoder.UseNumber()
+
+	var fileConfig map[string]interface{}
+	if err := decoder.Decode(&fileConfig); err != nil {
+		return nil, fmt.Errorf("Failed to parse plugin configuration file %q: %v", path, err)
+	}
+
+	merged := map[string]interface{}{}
+	for k, v := range fileConfig {
+		merged[k] = v
+	}
+	for k, v := range config {
+		if k != ConfigFileKey {
+			merged[k] = v
+		}
+	}
+
+	return merged, nil
+}
+
+// lowercaseConfigKeys returns a copy of the configuration value with the keys
+// of every hash in it lowercased
+func lowercaseConfigKeys(v interface{}) (interface{}, error) {
+	switch vv := v.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(vv))
+		for k := range vv {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		lowercased := make(map[string]interface{}, len(vv))
+		originals := make(map[string]string, len(vv))
+
+		for _, k := range keys {
+			lk := strings.ToLower(k)
+			if other, ok := originals[lk]; ok {
+				return nil, fmt.Errorf("Plugin configuration keys %q and %q only differ by case", other, k)
+			}
+			originals[lk] = k
+
+			value, err := lowercaseConfigKeys(vv[k])
+			if err != nil {
+				return nil, err
+			}
+			lowercased[lk] = value
+		}
+
+		return lowercased, nil
+
+	case []interface{}:
+		lowercased := make([]interface{}, len(vv))
+		for i, item := range vv {
+			value, err := lowercaseConfigKeys(item)
+			if err != nil {
+				return nil, err
+			}
+			lowercased[i] = value
+		}
+
+		return lowercased, nil
+
+	default:
+		return v, nil
+	}
+}
+
+// resolveSecrets returns a copy of the value with every secret reference
+// replaced with the secret's value, which is also added to secrets
+func resolveSecrets(v interface{}, provider SecretProvider, secrets *[]string) (interface{}, error) {
+	switch vv := v.(type) {
+	case map[string]interface{}:
+		if ref, ok := vv[SecretKey]; ok && len(vv) == 1 {
+			name, ok := ref.(string)
+			if !ok || name == "" {
+				return nil, fmt.Errorf("%s must be the name of a secret", SecretKey)
+			}
+			if provider == nil {
+				return nil, fmt.Errorf("Plugin configuration references the secret %q, but there are no secrets to look it up in", name)
+			}
+
+			value, err := provider.Secret(name)
+			if err != nil {
+				return nil, fmt.Errorf("Failed to resolve the secret %q: %v", name, err)
+			}
+
+			*secrets = append(*secrets, value)
+			return value, nil
+		}
+
+		resolved := make(map[string]interface{}, len(vv))
+		for k, vvv := range vv {
+			value, err := resolveSecrets(vvv, provider, secrets)
+			if err != nil {
+				return nil, err
+			}
+			resolved[k] = value
+		}
+
+		return resolved, nil
+
+	case []interface{}:
+		resolved := make([]interface{}, len(vv))
+		for i, item := range vv {
+			value, err := resolveSecrets(item, provider, secrets)
+			if err != nil {
+				return nil, err
+			}
+			resolved[i] = value
+		}
+
+		return resolved, nil
+
+	default:
+		return v, nil
+	}
+}
+
+// popReservedKey removes a reserved key from the configuration and returns
+// its value. The configuration is copied first so the caller's map is left
+// alone.
+func popReservedKey(config map[string]interface{}, key string) (map[string]interface{}, interface{}, bool) {
+	value, ok := config[key]
+	if !ok {
+		return config, nil, false
+	}
+
+	copied := make(map[string]interface{}, len(config)-1)
+	for k, v := range config {
+		if k != key {
+			copied[k] = v
+		}
+	}
+
+	return copied, value, true
+}
+
+// parseCheckoutDepth parses a checkout depth from configuration, which is a
+// whole number that's 0 or more
+func parseCheckoutDepth(v interface{}) (int, error) {
+	var s string
+	switch vv := v.(type) {
+	case int:
+		s = strconv.Itoa(vv)
+	case float64:
+		s = strconv.FormatFloat(vv, 'f', -1, 64)
+	case json.Number:
+		s = vv.String()
+	case string:
+		s = vv
+	default:
+		return 0, fmt.Errorf("Unknown type %T", v)
+	}
+
+	depth, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, err
+	}
+	if depth < 0 {
+		return 0, fmt.Errorf("Negative depth %d", depth)
+	}
+
+	return depth, nil
+}
+
 // Given a JSON structure, convert it to an array of plugins
 func CreateFromJSON(j string) ([]*Plugin, error) {
 	// Use more versatile number decoding
@@ -93,25 +494,8 @@ func CreateFromJSON(j string) ([]*Plugin, error) {
 			plugins = append(plugins, plugin)
 		case map[string]interface{}:
 			for location, config := range vv {
-				// Plugins without configs are easy!
-				if config == nil {
-					plugin, err := CreatePlugin(string(location), map[string]interface{}{})
-					if err != nil {
-						return nil, err
-					}
-
-					plugins = append(plugins, plugin)
-					continue
-				}
-
-				// Since there is a config, it's gotta be a hash
-				config, ok := config.(map[string]interface{})
-				if !ok {
-					return nil, fmt.Errorf("Configuration for \"%s\" is not a hash", location)
-				}
-
 				// Add the plugin with config to the array
-				plugin, err := CreatePlugin(string(location), config)
+				plugin, err := createPluginFromJSONConfig(location, config)
 				if err != nil {
 					return nil, err
 				}
@@ -126,131 +510,1212 @@ func CreateFromJSON(j string) ([]*Plugin, error) {
 	return plugins, nil
 }
 
-// Returns the name of the plugin
-func (p *Plugin) Name() string {
-	if p.Location != "" {
-		// for filepaths, we can get windows backslashes, so we normalize them
-		location := strings.Replace(p.Location, "\\", "/", -1)
+// CreatePluginsFromJSONStream reads newline delimited JSON arrays of plugins,
+// in the same format as CreateFromJSON, and returns all of the plugins from
+// every line. Blank lines are skipped.
+func CreatePluginsFromJSONStream(r io.Reader) ([]*Plugin, error) {
+	plugins := []*Plugin{}
+	reader := bufio.NewReader(r)
 
-		// Grab the last part of the location
-		parts := strings.Split(location, "/")
-		name := parts[len(parts)-1]
+	for lineNumber := 1; ; lineNumber++ {
+		line, err := reader.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
 
-		// Clean up the name
-		name = strings.ToLower(name)
-		name = regexp.MustCompile(`\s+`).ReplaceAllString(name, " ")
-		name = regexp.MustCompile(`[^a-zA-Z0-9]`).ReplaceAllString(name, "-")
-		name = strings.Replace(name, "-buildkite-plugin-git", "", -1)
-		name = strings.Replace(name, "-buildkite-plugin", "", -1)
+		if strings.TrimSpace(line) != "" {
+			linePlugins, parseErr := CreateFromJSON(line)
+			if parseErr != nil {
+				return nil, fmt.Errorf("Failed to parse plugins on line %d: %v", lineNumber, parseErr)
+			}
+			plugins = append(plugins, linePlugins...)
+		}
 
-		return name
-	} else {
-		return ""
+		if err == io.EOF {
+			return plugins, nil
+		}
 	}
 }
 
-// Returns an ID for the plugin that can be used as a folder name
-func (p *Plugin) Identifier() (string, error) {
-	nonIdCharacterRegex := regexp.MustCompile(`[^a-zA-Z0-9]`)
-	removeDoubleUnderscore := regexp.MustCompile(`-+`)
+// createPluginFromJSONConfig creates a plugin from the decoded JSON config
+// for a location, which is either a hash or null
+func createPluginFromJSONConfig(location string, config interface{}) (*Plugin, error) {
+	// Plugins without configs are easy!
+	if config == nil {
+		return CreatePlugin(location, map[string]interface{}{})
+	}
 
-	id := p.Label()
-	id = nonIdCharacterRegex.ReplaceAllString(id, "-")
-	id = removeDoubleUnderscore.ReplaceAllString(id, "-")
-	id = strings.Trim(id, "-")
+	// Since there is a config, it's gotta be a hash
+	hash, ok := config.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Configuration for \"%s\" is not a hash", location)
+	}
 
-	return id, nil
+	return CreatePlugin(location, hash)
 }
 
-// Returns the repository host where the code is stored
-func (p *Plugin) Repository() (string, error) {
-	s, err := p.constructRepositoryHost()
-	if err != nil {
-		return "", err
-	}
+// UnmarshalJSON decodes a single plugin, which is either a location string or
+// an object with the location as its only key and the configuration as its
+// value, in the same way as an element of CreateFromJSON
+func (p *Plugin) UnmarshalJSON(b []byte) error {
+	// Use more versatile number decoding
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	decoder.UseNumber()
 
-	// Add the authentication if there is one
-	if p.Authentication != "" {
-		s = p.Authentication + "@" + s
+	var f interface{}
+	if err := decoder.Decode(&f); err != nil {
+		return err
 	}
 
-	// If it's not a file system plugin, add the scheme
-	if !strings.HasPrefix(s, "/") {
-		if p.Scheme != "" {
-			s = p.Scheme + "://" + s
-		} else {
-			s = "https://" + s
+	var plugin *Plugin
+	var err error
+
+	switch v := f.(type) {
+	case string:
+		plugin, err = CreatePlugin(v, map[string]interface{}{})
+	case map[string]interface{}:
+		if len(v) != 1 {
+			return fmt.Errorf("A plugin definition must have exactly one key, found %d", len(v))
 		}
+		for location, config := range v {
+			plugin, err = createPluginFromJSONConfig(location, config)
+		}
+	default:
+		return fmt.Errorf("Unknown type in plugin definition (%s)", v)
 	}
 
-	return s, nil
-}
-
-// Returns the subdirectory path that the plugin is in
-func (p *Plugin) RepositorySubdirectory() (string, error) {
-	repository, err := p.constructRepositoryHost()
 	if err != nil {
-		return "", err
+		return err
 	}
 
-	dir := strings.TrimPrefix(p.Location, repository)
-
-	return strings.TrimPrefix(dir, "/"), nil
+	*p = *plugin
+	return nil
 }
 
-var (
-	toDashRegex            = regexp.MustCompile(`-|\s+`)
-	removeWhitespaceRegex  = regexp.MustCompile(`\s+`)
-	removeDoubleUnderscore = regexp.MustCompile(`_+`)
-)
+// GroupByRepository buckets the plugins by the repository they are checked
+// out from, so that plugins living in different subdirectories of the same
+// repository can share a single clone. Plugins that share a repository but
+// are pinned to different versions end up in different buckets. Within each
+// bucket plugins keep the order they were defined in.
+func (ps Plugins) GroupByRepository() (map[string]Plugins, error) {
+	groups := map[string]Plugins{}
 
-// formatEnvKey converts strings into an ENV key friendly format
-func formatEnvKey(key string) string {
-	key = strings.ToUpper(key)
-	key = removeWhitespaceRegex.ReplaceAllString(key, " ")
-	key = toDashRegex.ReplaceAllString(key, "_")
-	key = removeDoubleUnderscore.ReplaceAllString(key, "_")
-	return key
+	for _, p := range ps {
+		repo, err := p.Repository()
+		if err != nil {
+			return nil, err
+		}
+
+		key := repo
+		if p.Version != "" {
+			key = repo + "#" + p.Version
+		}
+
+		groups[key] = append(groups[key], p)
+	}
+
+	return groups, nil
 }
 
-func walkConfigValues(prefix string, v interface{}, into *[]string) error {
-	switch vv := v.(type) {
+// ConflictingVersions returns the repositories that plugins in the list are
+// checked out from at more than one version, with the distinct versions in the
+// order they were first seen. An unversioned plugin uses the version "", the
+// repository's default branch. Repositories are compared and returned without
+// any authentication, like LockKey, so the same repository with different
+// credentials is one repository and credentials aren't exposed. Vendored
+// plugins and plugins without a valid repository are ignored.
+func (ps Plugins) ConflictingVersions() map[string][]string {
+	versions := map[string][]string{}
 
-	// handles all of our primitive types, golang provides a good string representation
-	case string, bool, json.Number:
-		*into = append(*into, fmt.Sprintf("%s=%v", prefix, vv))
-		return nil
+	for _, p := range ps {
+		if p.Vendored {
+			continue
+		}
 
-	// handle lists of things, which get a KEY_N prefix depending on the index
-	case []interface{}:
-		for i := range vv {
-			if err := walkConfigValues(fmt.Sprintf("%s_%d", prefix, i), vv[i], into); err != nil {
-				return err
-			}
+		repo, err := p.repositoryWithoutAuth()
+		if err != nil {
+			continue
 		}
-		return nil
+
+		seen := false
+		for _, v := range versions[repo] {
+			if v == p.Version {
+				seen = true
+				break
+			}
+		}
+		if !seen {
+			versions[repo] = append(versions[repo], p.Version)
+		}
+	}
+
+	conflicts := map[string][]string{}
+	for repo, vs := range versions {
+		if len(vs) > 1 {
+			conflicts[repo] = vs
+		}
+	}
+
+	return conflicts
+}
+
+// Environment combines the environment variables of every plugin in the list.
+// The per-plugin BUILDKITE_PLUGIN_NAME and BUILDKITE_PLUGIN_CONFIGURATION
+// variables are left out, and it's an error for two plugins to share a name
+// or otherwise generate the same variable, as one would clobber the other.
+func (ps Plugins) Environment() (*env.Environment, error) {
+	combined := env.New()
+	names := map[string]*Plugin{}
+	owners := map[string]*Plugin{}
+
+	for _, p := range ps {
+		name := formatEnvKey(p.Name())
+		if other, ok := names[name]; ok {
+			return nil, fmt.Errorf("Plugins %s and %s both use the name %s", other.Label(), p.Label(), name)
+		}
+		names[name] = p
+
+		environ, err := p.ConfigurationToEnvironment()
+		if err != nil {
+			return nil, err
+		}
+
+		for k, v := range environ.ToMap() {
+			if k == "BUILDKITE_PLUGIN_NAME" || k == "BUILDKITE_PLUGIN_CONFIGURATION" {
+				continue
+			}
+			if other, ok := owners[k]; ok {
+				return nil, fmt.Errorf("Plugins %s and %s both set %s", other.Label(), p.Label(), k)
+			}
+			owners[k] = p
+			combined.Set(k, v)
+		}
+	}
+
+	return combined, nil
+}
+
+// MergePluginEnvironments combines the environment variables of every plugin
+// in the list, like Plugins.Environment, but resolves variables set by more
+// than one plugin rather than treating them as an error. The plugin with the
+// highest precedence, given its name, wins, and plugins with the same
+// precedence are resolved by their order in the list, where the later plugin
+// wins. Without a precedence function only the order is used. Every override
+// is logged.
+func MergePluginEnvironments(l logger.Logger, plugins Plugins, precedence func(name string) int) (*env.Environment, error) {
+	if precedence == nil {
+		precedence = func(string) int { return 0 }
+	}
+
+	merged := env.New()
+	owners := map[string]*Plugin{}
+
+	for _, p := range plugins {
+		environ, err := p.ConfigurationToEnvironment()
+		if err != nil {
+			return nil, err
+		}
+
+		vars := environ.ToMap()
+		keys := make([]string, 0, len(vars))
+		for k := range vars {
+			if k != "BUILDKITE_PLUGIN_NAME" && k != "BUILDKITE_PLUGIN_CONFIGURATION" {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			if other, ok := owners[k]; ok {
+				if precedence(p.Name()) < precedence(other.Name()) {
+					l.Info("Plugin %s sets %s, but plugin %s takes precedence", p.Label(), k, other.Label())
+					continue
+				}
+				l.Info("Plugin %s sets %s, overriding plugin %s", p.Label(), k, other.Label())
+			}
+			owners[k] = p
+			merged.Set(k, vars[k])
+		}
+	}
+
+	return merged, nil
+}
+
+// Validate checks every plugin and returns all of the problems found, in the
+// order of the plugins
+func (ps Plugins) Validate() []error {
+	var errs []error
+
+	for i, p := range ps {
+		if err := p.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("Plugin %d (%s): %v", i+1, p.Label(), err))
+		}
+	}
+
+	return errs
+}
+
+// DedupePlugins removes duplicate plugins from a list. Plugins checked out
+// from the same repository (ignoring any credentials), subdirectory and
+// version are treated as the same plugin, and if their configuration differs
+// the one defined last wins, which is logged. The result is ordered by where
+// each plugin was first defined.
+func DedupePlugins(l logger.Logger, plugins []*Plugin) []*Plugin {
+	deduped := []*Plugin{}
+	seen := map[string]int{}
+
+	for _, p := range plugins {
+		key := p.dedupeKey()
+
+		i, ok := seen[key]
+		if !ok {
+			seen[key] = len(deduped)
+			deduped = append(deduped, p)
+			continue
+		}
+
+		if !deduped[i].Equals(p) {
+			l.Info("Plugin %s is defined more than once with different configuration, using the last definition", p.Label())
+			deduped[i] = p
+		}
+	}
+
+	return deduped
+}
+
+// dedupeKey identifies the plugin for DedupePlugins by where it's checked out
+// from, falling back to its location for plugins without a repository
+func (p *Plugin) dedupeKey() string {
+	if p.Vendored {
+		return p.Label()
+	}
+
+	repository, err := p.repositoryWithoutAuth()
+	if err != nil {
+		return p.Label()
+	}
+
+	subdirectory, err := p.RepositorySubdirectory()
+	if err != nil {
+		return p.Label()
+	}
+
+	return repository + "//" + subdirectory + "#" + p.Version
+}
+
+// Equals returns whether two plugins have the same location, version,
+// checkout details and configuration
+func (p *Plugin) Equals(other *Plugin) bool {
+	if p == nil || other == nil {
+		return p == other
+	}
+	return reflect.DeepEqual(p, other)
+}
+
+// Checksum returns a hash of the plugin's location, version, checkout details
+// and configuration. Equal plugins have the same checksum.
+func (p *Plugin) Checksum() (string, error) {
+	// Map keys are sorted when marshalled, so this is stable
+	b, err := json.Marshal(p)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%x", sha256.Sum256(b)), nil
+}
+
+var conditionRegex = regexp.MustCompile(`^(!?)\$(?:\{([A-Za-z_][A-Za-z0-9_]*)\}|([A-Za-z_][A-Za-z0-9_]*))\s*(?:(==|!=)\s*(.*))?$`)
+
+type condition struct {
+	negate   bool
+	name     string
+	operator string
+	value    string
+}
+
+// parseCondition parses the small expression language used by ShouldRun
+func parseCondition(s string) (*condition, error) {
+	m := conditionRegex.FindStringSubmatch(strings.TrimSpace(s))
+	if m == nil {
+		return nil, fmt.Errorf("Invalid plugin condition %q", s)
+	}
+
+	c := &condition{negate: m[1] == "!", name: m[2] + m[3], operator: m[4], value: m[5]}
+
+	if c.negate && c.operator != "" {
+		return nil, fmt.Errorf("Invalid plugin condition %q, ! can't be used with %s", s, c.operator)
+	}
+
+	// Values can optionally be quoted
+	if len(c.value) >= 2 && (c.value[0] == '"' || c.value[0] == '\'') && c.value[len(c.value)-1] == c.value[0] {
+		c.value = c.value[1 : len(c.value)-1]
+	}
+
+	return c, nil
+}
+
+// ShouldRun evaluates the plugin's condition against an environment. Plugins
+// without a condition always run. A condition is one of:
+//
+//	$VAR            true if VAR is set and not empty
+//	!$VAR           true if VAR is unset or empty
+//	$VAR == value   true if VAR is equal to value
+//	$VAR != value   true if VAR isn't equal to value
+//
+// Unset variables compare as an empty string, and values can be quoted.
+func (p *Plugin) ShouldRun(environ *env.Environment) (bool, error) {
+	if p.Condition == "" {
+		return true, nil
+	}
+
+	c, err := parseCondition(p.Condition)
+	if err != nil {
+		return false, err
+	}
+
+	value, _ := environ.Get(c.name)
+
+	switch c.operator {
+	case "==":
+		return value == c.value, nil
+	case "!=":
+		return value != c.value, nil
+	default:
+		return (value != "") != c.negate, nil
+	}
+}
+
+// Returns the name of the plugin
+func (p *Plugin) Name() string {
+	if p.Location != "" {
+		// for filepaths, we can get windows backslashes, so we normalize them
+		location := strings.Replace(p.Location, "\\", "/", -1)
+
+		// Grab the last part of the location
+		parts := strings.Split(location, "/")
+		name := parts[len(parts)-1]
+
+		// A repository's .git suffix isn't part of the plugin's name
+		name = strings.TrimSuffix(name, ".git")
+
+		// Clean up the name
+		name = strings.ToLower(name)
+		name = regexp.MustCompile(`\s+`).ReplaceAllString(name, " ")
+		name = regexp.MustCompile(`[^a-zA-Z0-9]`).ReplaceAllString(name, "-")
+		name = strings.Replace(name, "-buildkite-plugin-git", "", -1)
+		name = strings.Replace(name, "-buildkite-plugin", "", -1)
+
+		return name
+	} else {
+		return ""
+	}
+}
+
+// Returns an ID for the plugin that can be used as a folder name
+func (p *Plugin) Identifier() (string, error) {
+	nonIdCharacterRegex := regexp.MustCompile(`[^a-zA-Z0-9]`)
+	removeDoubleUnderscore := regexp.MustCompile(`-+`)
+
+	id := p.Label()
+	id = nonIdCharacterRegex.ReplaceAllString(id, "-")
+	id = removeDoubleUnderscore.ReplaceAllString(id, "-")
+	id = strings.Trim(id, "-")
+
+	return id, nil
+}
+
+// Returns the repository host where the code is stored
+func (p *Plugin) Repository() (string, error) {
+	// Registered schemes decide their own repository
+	if resolver, ok := schemeResolver(p.Scheme); ok {
+		return resolver(p)
+	}
+
+	s, err := p.constructRepositoryHost()
+	if err != nil {
+		return "", err
+	}
+
+	// file:// plugins on the local file system are used from their path
+	if p.Scheme == "file" && (strings.HasPrefix(s, "/") || windowsDriveRegex.MatchString(s)) {
+		return s, nil
+	}
+
+	// Add the authentication if there is one
+	if p.Authentication != "" {
+		s = p.Authentication + "@" + s
+	}
+
+	// If it's not a file system plugin, add the scheme
+	if !strings.HasPrefix(s, "/") {
+		if p.Scheme != "" {
+			s = p.Scheme + "://" + s
+		} else {
+			s = "https://" + s
+		}
+	}
+
+	return s, nil
+}
+
+// RepositoryBoundary separates the repository from the subdirectory in a
+// plugin location, for repositories where it can't be worked out, e.g.
+// git.example.com/group/subgroup/repo//plugins/foo
+const RepositoryBoundary = "//"
+
+// splitRepositoryBoundary splits the location into the repository and the
+// subdirectory if it has an explicit RepositoryBoundary
+func (p *Plugin) splitRepositoryBoundary() (string, string, bool, error) {
+	if p.Vendored || p.Scheme == "file" {
+		return "", "", false, nil
+	}
+
+	parts := strings.Split(p.Location, RepositoryBoundary)
+	switch len(parts) {
+	case 1:
+		return "", "", false, nil
+	case 2:
+		if parts[1] == "" {
+			return "", "", false, fmt.Errorf("Plugin location \"%s\" has no subdirectory after %s", p.Location, RepositoryBoundary)
+		}
+		return parts[0], parts[1], true, nil
+	default:
+		return "", "", false, fmt.Errorf("Plugin location \"%s\" has more than one %s", p.Location, RepositoryBoundary)
+	}
+}
+
+// Returns the subdirectory path that the plugin is in
+func (p *Plugin) RepositorySubdirectory() (string, error) {
+	repository, err := p.constructRepositoryHost()
+	if err != nil {
+		return "", err
+	}
+
+	if _, subdirectory, hasBoundary, _ := p.splitRepositoryBoundary(); hasBoundary {
+		return subdirectory, nil
+	}
+
+	// The repository's host may have been lowercased, so skip over as many
+	// parts of the location as the repository has rather than its prefix
+	parts := strings.Split(p.Location, "/")
+	dir := parts[strings.Count(repository, "/")+1:]
+
+	return strings.Join(dir, "/"), nil
+}
+
+// PathWithinHost returns the plugin's location without the host it's stored
+// on, e.g. org/repo/subdir for github.com/org/repo/subdir
+func (p *Plugin) PathWithinHost() (string, error) {
+	if _, err := p.host(); err != nil {
+		return "", err
+	}
+
+	return strings.SplitN(p.Location, "/", 2)[1], nil
+}
+
+// MatchesHost returns whether the host the plugin is stored on matches any of
+// the glob patterns (e.g. *.internal.example.com), ignoring case
+func (p *Plugin) MatchesHost(patterns ...string) (bool, error) {
+	host, err := p.host()
+	if err != nil {
+		return false, err
+	}
+
+	for _, pattern := range patterns {
+		matched, err := path.Match(strings.ToLower(pattern), strings.ToLower(host))
+		if err != nil {
+			return false, fmt.Errorf("Invalid host pattern %q: %v", pattern, err)
+		}
+		if matched {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// host returns the host the plugin's repository is stored on
+func (p *Plugin) host() (string, error) {
+	if _, err := p.constructRepositoryHost(); err != nil {
+		return "", err
+	}
+
+	host := portRegex.ReplaceAllString(strings.SplitN(p.Location, "/", 2)[0], "")
+	if host == "" || p.Vendored || windowsDriveRegex.MatchString(p.Location) {
+		return "", fmt.Errorf("Plugin location \"%s\" has no host", p.Location)
+	}
+
+	return host, nil
+}
+
+var (
+	toDashRegex            = regexp.MustCompile(`-|\s+`)
+	removeWhitespaceRegex  = regexp.MustCompile(`\s+`)
+	removeDoubleUnderscore = regexp.MustCompile(`_+`)
+)
+
+// formatEnvKey converts strings into an ENV key friendly format
+func formatEnvKey(key string) string {
+	return formatEnvKeyKeepingCase(strings.ToUpper(key))
+}
+
+// formatEnvKeyKeepingCase is formatEnvKey without uppercasing the key
+func formatEnvKeyKeepingCase(key string) string {
+	key = removeWhitespaceRegex.ReplaceAllString(key, " ")
+	key = toDashRegex.ReplaceAllString(key, "_")
+	key = removeDoubleUnderscore.ReplaceAllString(key, "_")
+	return key
+}
+
+func walkConfigValues(prefix string, v interface{}, into *[]string, opts EnvironmentOptions) error {
+	switch vv := v.(type) {
+
+	// handles all of our primitive types, golang provides a good string representation
+	case string, bool, json.Number:
+		*into = append(*into, fmt.Sprintf("%s=%v", prefix, vv))
+		return nil
+
+	// numbers from configuration that wasn't decoded with json.Number are
+	// float64s, which are rendered without a decimal point when they're whole
+	case float64:
+		*into = append(*into, fmt.Sprintf("%s=%s", prefix, formatConfigFloat(vv)))
+		return nil
+
+	// null values are set but empty, so they can be told apart from keys
+	// that aren't there
+	case nil:
+		*into = append(*into, fmt.Sprintf("%s=", prefix))
+		return nil
+
+	// handle lists of things, which get a KEY_N prefix depending on the index,
+	// and lists of primitives can also be joined into a single KEY
+	case []interface{}:
+		if len(vv) == 0 && opts.CountEmpty {
+			*into = append(*into, fmt.Sprintf("%s_COUNT=0", prefix))
+		}
+
+		if opts.Arrays == ArraysJoined || opts.Arrays == ArraysIndexedAndJoined {
+			if joined, ok := joinConfigValues(vv, opts.ArraySeparator); ok {
+				*into = append(*into, fmt.Sprintf("%s=%s", prefix, joined))
+				if opts.Arrays == ArraysJoined {
+					return nil
+				}
+			}
+		}
+
+		for i := range vv {
+			if err := walkConfigValues(fmt.Sprintf("%s_%d", prefix, i), vv[i], into, opts); err != nil {
+				return err
+			}
+		}
+		return nil
 
 	// handle maps of things, which get a KEY_SUBKEY prefix depending on the map keys
 	case map[string]interface{}:
+		if len(vv) == 0 && opts.CountEmpty {
+			*into = append(*into, fmt.Sprintf("%s_COUNT=0", prefix))
+		}
+
 		for k, vvv := range vv {
-			if err := walkConfigValues(fmt.Sprintf("%s_%s", prefix, formatEnvKey(k)), vvv, into); err != nil {
+			if err := walkConfigValues(fmt.Sprintf("%s_%s", prefix, opts.formatKey(k)), vvv, into, opts); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	return fmt.Errorf("Unknown type %T %v", v, v)
+}
+
+// joinConfigValues joins a list of primitive values with the separator, and
+// returns false if the list contains other lists or maps
+func joinConfigValues(values []interface{}, separator string) (string, bool) {
+	if separator == "" {
+		separator = DefaultArraySeparator
+	}
+
+	parts := make([]string, len(values))
+	for i, v := range values {
+		switch v.(type) {
+		case string, bool, json.Number:
+			parts[i] = fmt.Sprintf("%v", v)
+		case float64:
+			parts[i] = formatConfigFloat(v.(float64))
+		case nil:
+			parts[i] = ""
+		default:
+			return "", false
+		}
+	}
+
+	return strings.Join(parts, separator), true
+}
+
+// formatConfigFloat formats a number the way it would be written, so 30 is
+// "30" rather than "30.000000" and 1.5 is "1.5"
+func formatConfigFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+var configReferenceRegex = regexp.MustCompile(`\$\$|\$\{([^}]+)\}|\$([a-zA-Z_][a-zA-Z0-9_]*)`)
+
+// interpolateConfig returns a copy of the configuration with references to
+// other top level string keys replaced with their values, which can refer to
+// other keys in turn. References are $key or ${key}, and $$ is a literal $.
+// References to missing or non-string keys, and cycles, are errors.
+func interpolateConfig(config map[string]interface{}) (map[string]interface{}, error) {
+	resolved := map[string]string{}
+	visiting := []string{}
+
+	var resolve func(key string) (string, error)
+	resolve = func(key string) (string, error) {
+		if value, ok := resolved[key]; ok {
+			return value, nil
+		}
+
+		for i, k := range visiting {
+			if k == key {
+				return "", fmt.Errorf("Plugin configuration keys reference each other in a cycle: %s -> %s", strings.Join(visiting[i:], " -> "), key)
+			}
+		}
+
+		raw, _ := config[key].(string)
+
+		visiting = append(visiting, key)
+		defer func() { visiting = visiting[:len(visiting)-1] }()
+
+		var resolveErr error
+		value := configReferenceRegex.ReplaceAllStringFunc(raw, func(match string) string {
+			if match == "$$" || resolveErr != nil {
+				return "$"
+			}
+
+			parts := configReferenceRegex.FindStringSubmatch(match)
+			ref := parts[1] + parts[2]
+
+			if _, ok := config[ref].(string); !ok {
+				resolveErr = fmt.Errorf("Plugin configuration key %q references %q, which isn't a top level string", key, ref)
+				return ""
+			}
+
+			value, err := resolve(ref)
+			if err != nil {
+				resolveErr = err
+			}
+			return value
+		})
+		if resolveErr != nil {
+			return "", resolveErr
+		}
+
+		resolved[key] = value
+		return value, nil
+	}
+
+	// Resolve in a consistent order so errors are consistent too
+	keys := make([]string, 0, len(config))
+	for k := range config {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	interpolated := make(map[string]interface{}, len(config))
+	for _, k := range keys {
+		if _, ok := config[k].(string); !ok {
+			interpolated[k] = config[k]
+			continue
+		}
+
+		value, err := resolve(k)
+		if err != nil {
+			return nil, err
+		}
+		interpolated[k] = value
+	}
+
+	return interpolated, nil
+}
+
+const (
+	// DefaultEnvironmentWarnCount is the number of environment variables a
+	// plugin configuration can generate before a warning is returned
+	DefaultEnvironmentWarnCount = 1000
+
+	// DefaultEnvironmentWarnSize is the total size in bytes of the environment
+	// variables a plugin configuration can generate before a warning is
+	// returned. Exec fails once the environment and arguments exceed ARG_MAX,
+	// which is as low as 256KiB on some systems.
+	DefaultEnvironmentWarnSize = 128 * 1024
+)
+
+// ConfigLimits are limits on the size of a plugin configuration that guard
+// against a runaway configuration generating a gigantic environment. Fields
+// that are zero use the defaults, which normal configurations never reach.
+type ConfigLimits struct {
+	// The number of keys across every hash in the configuration
+	MaxKeys int
+
+	// The number of items in any one list in the configuration
+	MaxListLength int
+
+	// The size of the configuration as JSON, in bytes
+	MaxSize int
+}
+
+const (
+	// DefaultConfigMaxKeys is the default ConfigLimits.MaxKeys
+	DefaultConfigMaxKeys = 10000
+
+	// DefaultConfigMaxListLength is the default ConfigLimits.MaxListLength
+	DefaultConfigMaxListLength = 10000
+
+	// DefaultConfigMaxSize is the default ConfigLimits.MaxSize
+	DefaultConfigMaxSize = 1024 * 1024
+)
+
+// check returns an error if the configuration is over any of the limits
+func (limits ConfigLimits) check(config map[string]interface{}) error {
+	maxKeys, maxListLength, maxSize := limits.MaxKeys, limits.MaxListLength, limits.MaxSize
+	if maxKeys == 0 {
+		maxKeys = DefaultConfigMaxKeys
+	}
+	if maxListLength == 0 {
+		maxListLength = DefaultConfigMaxListLength
+	}
+	if maxSize == 0 {
+		maxSize = DefaultConfigMaxSize
+	}
+
+	keys := 0
+	var walk func(key string, v interface{}) error
+	walk = func(key string, v interface{}) error {
+		switch vv := v.(type) {
+		case map[string]interface{}:
+			keys += len(vv)
+			for k, vvv := range vv {
+				if err := walk(k, vvv); err != nil {
+					return err
+				}
+			}
+		case []interface{}:
+			if len(vv) > maxListLength {
+				return fmt.Errorf("Plugin configuration key %q has %d items, which is more than the limit of %d", key, len(vv), maxListLength)
+			}
+			for _, vvv := range vv {
+				if err := walk(key, vvv); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+
+	if err := walk("", config); err != nil {
+		return err
+	}
+	if keys > maxKeys {
+		return fmt.Errorf("Plugin configuration has %d keys, which is more than the limit of %d", keys, maxKeys)
+	}
+
+	b, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+	if len(b) > maxSize {
+		return fmt.Errorf("Plugin configuration is %d bytes, which is more than the limit of %d", len(b), maxSize)
+	}
+
+	return nil
+}
+
+// KeyType is a hint about what kind of value a configuration key holds, so
+// that it can be validated and rendered consistently
+type KeyType string
+
+const (
+	// KeyTypeDuration values are durations, either in Go's duration syntax
+	// (e.g. "1m30s") or a number of seconds. They're rendered in Go's
+	// duration syntax.
+	KeyTypeDuration KeyType = "duration"
+
+	// KeyTypeBase64 values are base64 encoded strings, which are passed
+	// through as they are once they've been checked to decode cleanly
+	KeyTypeBase64 KeyType = "base64"
+)
+
+// EnvironmentOptions changes how a plugin configuration is converted into
+// environment variables. The zero value uses the defaults.
+type EnvironmentOptions struct {
+	// Warn when more than this many environment variables are generated
+	WarnCount int
+
+	// Warn when the generated environment variables are larger than this
+	// many bytes in total
+	WarnSize int
+
+	// Hints about the types of top level configuration keys
+	KeyTypes map[string]KeyType
+
+	// Include the repository the plugin came from, without any credentials,
+	// and the subdirectory within it as _REPOSITORY and _SUBDIRECTORY
+	Provenance bool
+
+	// Replace $key and ${key} in top level string values with the value of
+	// another top level string key, see interpolateConfig
+	Interpolate bool
+
+	// How lists are rendered, which defaults to ArraysIndexed
+	Arrays ArrayRendering
+
+	// The separator for lists rendered as a single variable, which defaults
+	// to DefaultArraySeparator
+	ArraySeparator string
+
+	// Keep the case of configuration keys in variable names, so myKey
+	// becomes BUILDKITE_PLUGIN_FOO_myKey rather than BUILDKITE_PLUGIN_FOO_MYKEY
+	PreserveKeyCase bool
+
+	// Set KEY_COUNT=0 for empty lists and maps, which otherwise don't
+	// produce any variables, so hooks can tell them apart from keys that
+	// aren't set
+	CountEmpty bool
+
+	// Limits on the size of the configuration, which is checked again as it
+	// may have changed since the plugin was created
+	Limits ConfigLimits
+}
+
+// formatKey formats a configuration key for use in a variable name
+func (opts EnvironmentOptions) formatKey(key string) string {
+	if opts.PreserveKeyCase {
+		return formatEnvKeyKeepingCase(key)
+	}
+	return formatEnvKey(key)
+}
+
+// ArrayRendering is how lists in the configuration become environment
+// variables
+type ArrayRendering string
+
+const (
+	// ArraysIndexed renders each item as KEY_0, KEY_1 and so on
+	ArraysIndexed ArrayRendering = ""
+
+	// ArraysJoined renders a list of strings, booleans and numbers as a single
+	// KEY with the items joined by the separator, like KEY=a:b:c. Lists that
+	// contain other lists or maps are still indexed.
+	ArraysJoined ArrayRendering = "joined"
+
+	// ArraysIndexedAndJoined renders lists in both ways
+	ArraysIndexedAndJoined ArrayRendering = "indexed-and-joined"
+)
+
+// DefaultArraySeparator joins lists rendered as a single variable
+const DefaultArraySeparator = ","
+
+// Converts the plugin configuration values to environment variables
+func (p *Plugin) ConfigurationToEnvironment() (*env.Environment, error) {
+	environ, _, err := p.ConfigurationToEnvironmentWithOptions(EnvironmentOptions{})
+	return environ, err
+}
+
+// ConfigurationJSON returns the plugin configuration as JSON with its keys
+// sorted, which keeps nested values intact unlike the environment variables
+func (p *Plugin) ConfigurationJSON() (string, error) {
+	config := p.Configuration
+	if config == nil {
+		config = map[string]interface{}{}
+	}
+
+	// Maps are always marshalled with their keys sorted
+	b, err := json.Marshal(config)
+	if err != nil {
+		return "", err
+	}
+
+	return string(b), nil
+}
+
+// ConfigurationToEnvironmentWithOptions converts the plugin configuration
+// values to environment variables, and returns any warnings about the
+// environment that was generated
+func (p *Plugin) ConfigurationToEnvironmentWithOptions(opts EnvironmentOptions) (*env.Environment, []string, error) {
+	envSlice, err := p.environmentSlice(opts)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return env.FromSlice(envSlice), environmentWarnings(p, envSlice, opts), nil
+}
+
+// ForEachEnvVar calls fn with each environment variable that the plugin
+// configuration converts to, in the same order as ConfigurationToEnvironment,
+// without building an environment. It stops at the first error, which can
+// come after fn has already been called for some of the variables.
+func (p *Plugin) ForEachEnvVar(fn func(name, value string) error) error {
+	if err := (ConfigLimits{}).check(p.Configuration); err != nil {
+		return err
+	}
+
+	config := p.Configuration
+	if config == nil {
+		config = map[string]interface{}{}
+	}
+
+	configJson, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+
+	envPrefix := fmt.Sprintf("BUILDKITE_PLUGIN_%s", formatEnvKey(p.Name()))
+
+	// The variables from the configuration all share a prefix, so they sort
+	// together, with the name and configuration variables either side
+	var before, after [][2]string
+	for _, e := range [][2]string{
+		{"BUILDKITE_PLUGIN_CONFIGURATION", string(configJson)},
+		{"BUILDKITE_PLUGIN_NAME", formatEnvKey(p.Name())},
+	} {
+		if e[0]+"="+e[1] < envPrefix+"_" {
+			before = append(before, e)
+		} else {
+			after = append(after, e)
+		}
+	}
+
+	for _, e := range before {
+		if err := fn(e[0], e[1]); err != nil {
+			return err
+		}
+	}
+
+	if err := forEachEnvChild(p, envPrefix, configEnvChildren(config), fn); err != nil {
+		return err
+	}
+
+	for _, e := range after {
+		if err := fn(e[0], e[1]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// envChild is a value in a configuration map or list, with the key it adds to
+// the variable name and the key it sorts by
+type envChild struct {
+	key     string
+	sortKey string
+	value   interface{}
+}
+
+// configEnvChildren returns the values in a configuration map, keyed by their
+// formatted keys
+func configEnvChildren(config map[string]interface{}) []envChild {
+	children := make([]envChild, 0, len(config))
+	for k, v := range config {
+		children = append(children, newEnvChild(formatEnvKey(k), v))
+	}
+	return children
+}
+
+// newEnvChild creates an envChild. Values sort by their key followed by = and
+// maps and lists by their key followed by _, which is what the variables
+// they're rendered as start with.
+func newEnvChild(key string, v interface{}) envChild {
+	switch v.(type) {
+	case []interface{}, map[string]interface{}:
+		return envChild{key: key, sortKey: key + "_", value: v}
+	}
+	return envChild{key: key, sortKey: key + "=", value: v}
+}
+
+// forEachEnvChild calls fn with the variables for each of the children of a
+// map or list in the configuration, in the order they sort in. Where one
+// child's sort key is a prefix of another's, like a list "a" and a value
+// "a_b", their variables can interleave or clash, so those are rendered
+// together and sorted, and the last of any that clash is used.
+func forEachEnvChild(p *Plugin, prefix string, children []envChild, fn func(name, value string) error) error {
+	sort.Slice(children, func(i, j int) bool {
+		return children[i].sortKey < children[j].sortKey
+	})
+
+	for i := 0; i < len(children); {
+		group := children[i : i+1]
+		for i+len(group) < len(children) && strings.HasPrefix(children[i+len(group)].sortKey, group[0].sortKey) {
+			group = children[i : i+len(group)+1]
+		}
+		i += len(group)
+
+		if len(group) == 1 {
+			if err := forEachEnvValue(p, prefix+"_"+group[0].key, group[0].value, fn); err != nil {
+				return err
+			}
+			continue
+		}
+
+		envSlice := []string{}
+		for _, c := range group {
+			if err := walkConfigValues(prefix+"_"+c.key, c.value, &envSlice, EnvironmentOptions{}); err != nil {
+				return err
+			}
+		}
+
+		sort.Strings(envSlice)
+
+		for j, e := range envSlice {
+			kv := strings.SplitN(e, "=", 2)
+
+			// Where keys clash the last one wins, as it does when the
+			// variables are added to an environment
+			if j+1 < len(envSlice) && strings.HasPrefix(envSlice[j+1], kv[0]+"=") {
+				continue
+			}
+			if err := fn(kv[0], kv[1]); err != nil {
 				return err
 			}
 		}
-		return nil
 	}
 
-	return fmt.Errorf("Unknown type %T %v", v, v)
+	return nil
 }
 
-// Converts the plugin configuration values to environment variables
-func (p *Plugin) ConfigurationToEnvironment() (*env.Environment, error) {
+// forEachEnvValue calls fn with the variables for a single configuration value
+func forEachEnvValue(p *Plugin, name string, v interface{}, fn func(name, value string) error) error {
+	switch vv := v.(type) {
+	case []interface{}:
+		children := make([]envChild, len(vv))
+		for i := range vv {
+			children[i] = newEnvChild(strconv.Itoa(i), vv[i])
+		}
+		return forEachEnvChild(p, name, children, fn)
+
+	case map[string]interface{}:
+		return forEachEnvChild(p, name, configEnvChildren(vv), fn)
+	}
+
+	envSlice := []string{}
+	if err := walkConfigValues(name, v, &envSlice, EnvironmentOptions{}); err != nil {
+		return err
+	}
+
+	kv := strings.SplitN(envSlice[0], "=", 2)
+	return fn(kv[0], kv[1])
+}
+
+// EnvironmentToPluginConfig rebuilds the configuration of the named plugin from
+// its BUILDKITE_PLUGIN_<NAME>_* environment variables, for hooks that only have
+// the environment. Each _ in a variable's name is a level of nesting, and a
+// level where every key is an index from 0 becomes a list.
+//
+// The conversion is lossy. Every value is a string, keys are lowercase, keys
+// containing _ or - become nested maps, a value that's also the parent of
+// other variables (like a joined list) is dropped, and variables of plugins
+// whose names start with this plugin's name are included. Use
+// BUILDKITE_PLUGIN_CONFIGURATION where the exact configuration is needed.
+func EnvironmentToPluginConfig(environ *env.Environment, pluginName string) (map[string]interface{}, error) {
+	prefix := fmt.Sprintf("BUILDKITE_PLUGIN_%s_", formatEnvKey(pluginName))
+	config := map[string]interface{}{}
+
+	for name, value := range environ.ToMap() {
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+
+		path := strings.Split(strings.ToLower(strings.TrimPrefix(name, prefix)), "_")
+		for _, key := range path {
+			if key == "" {
+				return nil, fmt.Errorf("The environment variable %s doesn't name a plugin configuration key", name)
+			}
+		}
+
+		setConfigPath(config, path, value)
+	}
+
+	for k, v := range config {
+		config[k] = listsFromConfigMaps(v)
+	}
+
+	return config, nil
+}
+
+// setConfigPath sets the value at the path of nested maps, creating them as
+// needed. Maps take precedence over values at the same path.
+func setConfigPath(config map[string]interface{}, path []string, value string) {
+	for _, key := range path[:len(path)-1] {
+		child, ok := config[key].(map[string]interface{})
+		if !ok {
+			child = map[string]interface{}{}
+			config[key] = child
+		}
+		config = child
+	}
+
+	last := path[len(path)-1]
+	if _, ok := config[last].(map[string]interface{}); !ok {
+		config[last] = value
+	}
+}
+
+// listsFromConfigMaps converts maps whose keys are all the indexes from 0 into
+// lists, recursively
+func listsFromConfigMaps(v interface{}) interface{} {
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return v
+	}
+
+	for k, vv := range m {
+		m[k] = listsFromConfigMaps(vv)
+	}
+
+	list := make([]interface{}, len(m))
+	for i := range list {
+		vv, ok := m[fmt.Sprintf("%d", i)]
+		if !ok {
+			return m
+		}
+		list[i] = vv
+	}
+
+	return list
+}
+
+// environmentSlice converts the plugin configuration to a slice of KEY=value
+// environment variables
+func (p *Plugin) environmentSlice(opts EnvironmentOptions) ([]string, error) {
 	envSlice := []string{}
 	envPrefix := fmt.Sprintf("BUILDKITE_PLUGIN_%s", formatEnvKey(p.Name()))
 
-	for k, v := range p.Configuration {
-		configPrefix := fmt.Sprintf("%s_%s", envPrefix, formatEnvKey(k))
-		if err := walkConfigValues(configPrefix, v, &envSlice); err != nil {
+	switch opts.Arrays {
+	case ArraysIndexed, ArraysJoined, ArraysIndexedAndJoined:
+	default:
+		return nil, fmt.Errorf("Unknown array rendering %q, expected %q or %q", opts.Arrays, ArraysJoined, ArraysIndexedAndJoined)
+	}
+
+	if err := opts.Limits.check(p.Configuration); err != nil {
+		return nil, err
+	}
+
+	config := p.Configuration
+	if opts.Interpolate {
+		var err error
+		if config, err = interpolateConfig(config); err != nil {
+			return nil, err
+		}
+	}
+
+	for k, v := range config {
+		if t, ok := opts.KeyTypes[k]; ok {
+			var err error
+			if v, err = normalizeConfigValue(k, t, v); err != nil {
+				return nil, err
+			}
+		}
+
+		configPrefix := fmt.Sprintf("%s_%s", envPrefix, opts.formatKey(k))
+		if err := walkConfigValues(configPrefix, v, &envSlice, opts); err != nil {
 			return nil, err
 		}
 	}
@@ -258,17 +1723,499 @@ func (p *Plugin) ConfigurationToEnvironment() (*env.Environment, error) {
 	// Sort them into a consistent order
 	sort.Strings(envSlice)
 
+	// Different keys can be formatted into the same variable. By default the
+	// last one wins when they're added to an environment, but keeping key
+	// case or joining lists are opt-in, so clashes there are an error.
+	if opts.PreserveKeyCase || opts.Arrays != ArraysIndexed {
+		for i := 1; i < len(envSlice); i++ {
+			name := strings.SplitN(envSlice[i], "=", 2)[0]
+			if strings.HasPrefix(envSlice[i-1], name+"=") {
+				return nil, fmt.Errorf("The configuration for plugin %q sets %s more than once", p.Name(), name)
+			}
+		}
+	}
+
+	if opts.Provenance && !p.Vendored {
+		provenance, err := p.provenanceEnvironment(envPrefix)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, e := range provenance {
+			name := strings.SplitN(e, "=", 2)[0]
+			for _, existing := range envSlice {
+				if strings.HasPrefix(existing, name+"=") {
+					return nil, fmt.Errorf("The configuration for plugin %q sets %s, which is reserved for the plugin's provenance", p.Name(), name)
+				}
+			}
+		}
+
+		envSlice = append(envSlice, provenance...)
+	}
+
 	// Append current plugin name
 	envSlice = append(envSlice, fmt.Sprintf("BUILDKITE_PLUGIN_NAME=%s", formatEnvKey(p.Name())))
 
 	// Append current plugin configuration as JSON
-	configJson, err := json.Marshal(p.Configuration)
+	configJson, err := json.Marshal(config)
 	if err != nil {
 		return nil, err
 	}
 	envSlice = append(envSlice, fmt.Sprintf("BUILDKITE_PLUGIN_CONFIGURATION=%s", configJson))
 
-	return env.FromSlice(envSlice), nil
+	return envSlice, nil
+}
+
+// normalizeConfigValue validates a configuration value against its type hint
+// and converts it into a canonical form
+func normalizeConfigValue(key string, t KeyType, v interface{}) (interface{}, error) {
+	switch t {
+	case KeyTypeDuration:
+		var d time.Duration
+		var err error
+
+		switch vv := v.(type) {
+		case string:
+			d, err = time.ParseDuration(vv)
+		case json.Number:
+			var seconds float64
+			seconds, err = vv.Float64()
+			d = time.Duration(seconds * float64(time.Second))
+		case float64:
+			d = time.Duration(vv * float64(time.Second))
+		case int:
+			d = time.Duration(vv) * time.Second
+		default:
+			err = fmt.Errorf("expected a string or number, got %T", v)
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("Invalid duration for plugin configuration key %q: %v", key, err)
+		}
+
+		return d.String(), nil
+
+	case KeyTypeBase64:
+		s, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("Invalid base64 for plugin configuration key %q: expected a string, got %T", key, v)
+		}
+
+		if _, err := base64.StdEncoding.DecodeString(s); err != nil {
+			return nil, fmt.Errorf("Invalid base64 for plugin configuration key %q: %v", key, err)
+		}
+
+		return s, nil
+	}
+
+	return nil, fmt.Errorf("Unknown type %q for plugin configuration key %q", t, key)
+}
+
+// environmentWarnings checks whether the generated environment is getting big
+// enough to cause exec to fail when a hook is run
+func environmentWarnings(p *Plugin, envSlice []string, opts EnvironmentOptions) []string {
+	warnings := []string{}
+
+	warnCount := opts.WarnCount
+	if warnCount == 0 {
+		warnCount = DefaultEnvironmentWarnCount
+	}
+
+	warnSize := opts.WarnSize
+	if warnSize == 0 {
+		warnSize = DefaultEnvironmentWarnSize
+	}
+
+	if len(envSlice) > warnCount {
+		warnings = append(warnings, fmt.Sprintf(
+			"The configuration for plugin %q generates %d environment variables, which is more than %d and may cause hooks to fail to run",
+			p.Name(), len(envSlice), warnCount))
+	}
+
+	// Each variable is passed to exec as a null terminated KEY=VALUE string
+	size := 0
+	for _, e := range envSlice {
+		size += len(e) + 1
+	}
+
+	if size > warnSize {
+		warnings = append(warnings, fmt.Sprintf(
+			"The configuration for plugin %q generates %d bytes of environment variables, which is more than %d and may cause hooks to fail to run",
+			p.Name(), size, warnSize))
+	}
+
+	return warnings
+}
+
+// parseFragment splits a location's fragment into the version and any options
+// that follow it, e.g. v1.0;shallow;depth=1
+func parseFragment(fragment string) (string, map[string]string) {
+	parts := strings.Split(fragment, ";")
+
+	var options map[string]string
+	for _, part := range parts[1:] {
+		if part == "" {
+			continue
+		}
+		if options == nil {
+			options = map[string]string{}
+		}
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) == 2 {
+			options[kv[0]] = kv[1]
+		} else {
+			options[kv[0]] = ""
+		}
+	}
+
+	return parts[0], options
+}
+
+// Fragment returns the fragment of the plugin's location, which is the
+// version followed by any options. Options are sorted by name.
+func (p *Plugin) Fragment() string {
+	fragment := p.Version
+
+	names := make([]string, 0, len(p.Options))
+	for name := range p.Options {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if value := p.Options[name]; value != "" {
+			fragment += ";" + name + "=" + value
+		} else {
+			fragment += ";" + name
+		}
+	}
+
+	return fragment
+}
+
+// Validate checks that the plugin can be checked out and run, which catches
+// the problems that otherwise wouldn't surface until the plugin is used
+func (p *Plugin) Validate() error {
+	if !p.Vendored {
+		if _, err := p.Repository(); err != nil {
+			return err
+		}
+	}
+
+	if p.Condition != "" {
+		if _, err := parseCondition(p.Condition); err != nil {
+			return err
+		}
+	}
+
+	if p.RequiredAgentVersion != "" {
+		if _, err := parseVersionConstraints(p.RequiredAgentVersion); err != nil {
+			return err
+		}
+	}
+
+	if _, err := p.ConfigurationToEnvironment(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// RequireKeys checks that the configuration sets each of the keys, and returns
+// an error listing all of the missing ones. Nested keys are separated by dots,
+// like build.image, and can include list indexes, like build.args.0. Keys set
+// to null are present.
+func (p *Plugin) RequireKeys(keys ...string) error {
+	var missing []string
+	for _, key := range keys {
+		if !hasConfigKey(p.Configuration, strings.Split(key, ".")) {
+			missing = append(missing, key)
+		}
+	}
+
+	switch len(missing) {
+	case 0:
+		return nil
+	case 1:
+		return fmt.Errorf("The configuration for plugin %q is missing the required key %s", p.Name(), missing[0])
+	default:
+		return fmt.Errorf("The configuration for plugin %q is missing the required keys %s", p.Name(), strings.Join(missing, ", "))
+	}
+}
+
+// hasConfigKey returns whether the configuration value has the path of keys
+func hasConfigKey(v interface{}, path []string) bool {
+	if len(path) == 0 {
+		return true
+	}
+
+	switch vv := v.(type) {
+	case map[string]interface{}:
+		child, ok := vv[path[0]]
+		return ok && hasConfigKey(child, path[1:])
+	case []interface{}:
+		i, err := strconv.Atoi(path[0])
+		return err == nil && i >= 0 && i < len(vv) && hasConfigKey(vv[i], path[1:])
+	default:
+		return false
+	}
+}
+
+// ConfigurationString returns the configuration on one line with its keys
+// sorted, like {image: alpine, ports: [80, 443], token: ***}, for logging. The
+// values of the secret keys, which can be nested like in RequireKeys, are
+// shown as ***, as are strings containing a secret that was resolved into the
+// configuration. It's not meant to be parsed, see ConfigurationJSON for that.
+func (p *Plugin) ConfigurationString(secretKeys ...string) string {
+	secrets := map[string]bool{}
+	for _, key := range secretKeys {
+		secrets[key] = true
+	}
+
+	config := p.Configuration
+	if config == nil {
+		config = map[string]interface{}{}
+	}
+
+	var b strings.Builder
+	p.writeConfigString(&b, "", config, secrets)
+	return b.String()
+}
+
+// Strings that don't need quoting to be read back from ConfigurationString
+var plainConfigStringRegex = regexp.MustCompile(`^[^\s,:{}\[\]"'\\]+$`)
+
+// writeConfigString writes a configuration value for ConfigurationString,
+// where path is the dotted path of keys to the value
+func (p *Plugin) writeConfigString(b *strings.Builder, path string, v interface{}, secretKeys map[string]bool) {
+	switch vv := v.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(vv))
+		for k := range vv {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		b.WriteString("{")
+		for i, k := range keys {
+			if i > 0 {
+				b.WriteString(", ")
+			}
+			b.WriteString(k + ": ")
+			p.writeConfigChild(b, path, k, vv[k], secretKeys)
+		}
+		b.WriteString("}")
+
+	case []interface{}:
+		b.WriteString("[")
+		for i := range vv {
+			if i > 0 {
+				b.WriteString(", ")
+			}
+			p.writeConfigChild(b, path, strconv.Itoa(i), vv[i], secretKeys)
+		}
+		b.WriteString("]")
+
+	case string:
+		for _, secret := range p.Secrets {
+			if secret != "" && strings.Contains(vv, secret) {
+				b.WriteString("***")
+				return
+			}
+		}
+		if plainConfigStringRegex.MatchString(vv) {
+			b.WriteString(vv)
+		} else {
+			b.WriteString(strconv.Quote(vv))
+		}
+
+	case float64:
+		b.WriteString(formatConfigFloat(vv))
+
+	case nil:
+		b.WriteString("null")
+
+	default:
+		fmt.Fprintf(b, "%v", vv)
+	}
+}
+
+// writeConfigChild writes a value within a map or list, or *** if it's secret
+func (p *Plugin) writeConfigChild(b *strings.Builder, path string, key string, v interface{}, secretKeys map[string]bool) {
+	if path != "" {
+		key = path + "." + key
+	}
+	if secretKeys[key] {
+		b.WriteString("***")
+		return
+	}
+	p.writeConfigString(b, key, v, secretKeys)
+}
+
+// LockKey returns a name for a lock that serializes checkouts of the same
+// plugin repository and version across processes. It's made of the plugin's
+// name and a hash of the repository (without any credentials) and version, so
+// it's safe to use as a file name.
+func (p *Plugin) LockKey() string {
+	repository, err := p.repositoryWithoutAuth()
+	if err != nil || p.Vendored {
+		repository = p.Location
+	}
+
+	sum := sha256.Sum256([]byte(repository + "#" + p.Version))
+
+	return fmt.Sprintf("%s-%x", p.Name(), sum[:8])
+}
+
+// repositoryWithoutAuth returns the repository without any authentication, so
+// that it's safe to show
+func (p *Plugin) repositoryWithoutAuth() (string, error) {
+	withoutAuth := *p
+	withoutAuth.Authentication = ""
+
+	return withoutAuth.Repository()
+}
+
+// RepositoryRedacted returns the repository like Repository, but with any
+// authentication replaced with ***, so that it's safe to log
+func (p *Plugin) RepositoryRedacted() (string, error) {
+	redacted := *p
+	if redacted.Authentication != "" {
+		redacted.Authentication = "***"
+	}
+
+	return redacted.Repository()
+}
+
+// IsLocal returns whether the plugin is used from this machine rather than
+// checked out, which is the case for vendored plugins and file:// paths
+func (p *Plugin) IsLocal() bool {
+	if p.Vendored {
+		return true
+	}
+
+	return p.Scheme == "file" && (strings.HasPrefix(p.Location, "/") || windowsDriveRegex.MatchString(p.Location))
+}
+
+// PluginKind is how a plugin is fetched, which is worked out from its location
+type PluginKind string
+
+const (
+	// PluginKindUnknown is a plugin that can't be fetched in any known way
+	PluginKindUnknown PluginKind = "unknown"
+
+	// PluginKindGit is a plugin in a git repository
+	PluginKindGit PluginKind = "git"
+
+	// PluginKindLocal is a plugin that's already on this machine, either
+	// vendored or at a file:// path
+	PluginKindLocal PluginKind = "local"
+
+	// PluginKindTarball is a plugin in an archive like plugin.tar.gz
+	PluginKindTarball PluginKind = "tarball"
+)
+
+var (
+	tarballRegex = regexp.MustCompile(`\.(tar|tgz|tar\.gz|tar\.bz2|tar\.xz)$`)
+
+	// The schemes that plugins in git repositories can be fetched with
+	gitSchemes = map[string]bool{
+		"":          true,
+		"file":      true,
+		"git":       true,
+		"git+https": true,
+		"git+ssh":   true,
+		"http":      true,
+		"https":     true,
+		"ssh":       true,
+	}
+)
+
+// Kind returns how the plugin is fetched, so that callers can switch on it
+// rather than inspecting the scheme and location themselves
+func (p *Plugin) Kind() PluginKind {
+	switch {
+	case p.Location == "":
+		return PluginKindUnknown
+	case p.IsLocal():
+		return PluginKindLocal
+	case !gitSchemes[p.Scheme] && !hasSchemeResolver(p.Scheme):
+		return PluginKindUnknown
+	case tarballRegex.MatchString(strings.ToLower(p.Location)):
+		return PluginKindTarball
+	default:
+		return PluginKindGit
+	}
+}
+
+// PluginSummary describes a plugin in a single structure for tooling and
+// JSON output
+type PluginSummary struct {
+	Name         string   `json:"name"`
+	Label        string   `json:"label"`
+	Identifier   string   `json:"identifier"`
+	Repository   string   `json:"repository,omitempty"`
+	Subdirectory string   `json:"subdirectory,omitempty"`
+	Version      string   `json:"version,omitempty"`
+	Scheme       string   `json:"scheme,omitempty"`
+	IsLocal      bool     `json:"is_local"`
+	ConfigKeys   []string `json:"config_keys"`
+}
+
+// Summary describes the plugin. The repository has any authentication
+// redacted, and is left out along with the subdirectory for vendored plugins,
+// which aren't checked out from a repository.
+func (p *Plugin) Summary() (PluginSummary, error) {
+	id, err := p.Identifier()
+	if err != nil {
+		return PluginSummary{}, err
+	}
+
+	summary := PluginSummary{
+		Name:       p.Name(),
+		Label:      p.Label(),
+		Identifier: id,
+		Version:    p.Version,
+		Scheme:     p.Scheme,
+		IsLocal:    p.IsLocal(),
+		ConfigKeys: []string{},
+	}
+
+	if !p.Vendored {
+		if summary.Repository, err = p.RepositoryRedacted(); err != nil {
+			return PluginSummary{}, err
+		}
+		if summary.Subdirectory, err = p.RepositorySubdirectory(); err != nil {
+			return PluginSummary{}, err
+		}
+	}
+
+	for k := range p.Configuration {
+		summary.ConfigKeys = append(summary.ConfigKeys, k)
+	}
+	sort.Strings(summary.ConfigKeys)
+
+	return summary, nil
+}
+
+// provenanceEnvironment returns the variables that describe where the plugin
+// came from. Authentication is left out of the repository so credentials
+// don't end up in the environment of hooks.
+func (p *Plugin) provenanceEnvironment(envPrefix string) ([]string, error) {
+	repository, err := p.repositoryWithoutAuth()
+	if err != nil {
+		return nil, err
+	}
+
+	subdirectory, err := p.RepositorySubdirectory()
+	if err != nil {
+		return nil, err
+	}
+
+	return []string{
+		fmt.Sprintf("%s_REPOSITORY=%s", envPrefix, repository),
+		fmt.Sprintf("%s_SUBDIRECTORY=%s", envPrefix, subdirectory),
+	}, nil
 }
 
 // Pretty name for the plugin
@@ -285,19 +2232,45 @@ func (p *Plugin) constructRepositoryHost() (string, error) {
 		return "", fmt.Errorf("Missing plugin location")
 	}
 
-	parts := strings.Split(p.Location, "/")
+	location := p.Location
+
+	// An explicit boundary between the repository and the subdirectory
+	// takes the place of working it out from the location
+	repository, _, hasBoundary, err := p.splitRepositoryBoundary()
+	if err != nil {
+		return "", err
+	}
+	if hasBoundary {
+		location = repository
+	}
+
+	parts := strings.Split(location, "/")
 	if len(parts) < 2 {
 		return "", fmt.Errorf("Incomplete plugin path \"%s\"", p.Location)
 	}
 
+	// Hosts are case insensitive, so they're lowercased to keep the
+	// repository the same however the host is written
+	if !p.Vendored && p.Scheme != "file" {
+		parts[0] = strings.ToLower(parts[0])
+	}
+
 	var s string
 
-	if parts[0] == "github.com" || parts[0] == "bitbucket.org" || parts[0] == "gitlab.com" {
+	// Known hosts are recognised with or without a port
+	hostname := portRegex.ReplaceAllString(parts[0], "")
+
+	if hostname == "github.com" || hostname == "bitbucket.org" || hostname == "gitlab.com" {
 		if len(parts) < 3 {
-			return "", fmt.Errorf("Incomplete %s path \"%s\"", parts[0], p.Location)
+			return "", fmt.Errorf("Incomplete %s path \"%s\"", hostname, p.Location)
+		}
+		if hasBoundary && len(parts) > 3 {
+			return "", fmt.Errorf("Plugin location \"%s\" has %s after the repository, but %s repositories are always an org and a repo", p.Location, RepositoryBoundary, hostname)
 		}
 
 		s = strings.Join(parts[:3], "/")
+	} else if hasBoundary {
+		s = strings.Join(parts, "/")
 	} else {
 		repo := []string{}
 
@@ -0,0 +1,49 @@
+package plugin
+
+import (
+	"strings"
+	"sync"
+)
+
+// SchemeResolver returns the repository that a plugin with a custom scheme is
+// checked out from, e.g. turning artifactory://plugins/docker-compose into a URL on
+// an internal server
+type SchemeResolver func(p *Plugin) (string, error)
+
+var (
+	schemeResolversMu sync.RWMutex
+	schemeResolvers   = map[string]SchemeResolver{}
+)
+
+// RegisterPluginScheme registers a resolver that Repository uses for plugins
+// with the scheme, in place of building the repository from the location.
+// Schemes are case insensitive, and registering a nil resolver removes it.
+func RegisterPluginScheme(scheme string, resolver SchemeResolver) {
+	schemeResolversMu.Lock()
+	defer schemeResolversMu.Unlock()
+
+	if resolver == nil {
+		delete(schemeResolvers, strings.ToLower(scheme))
+	} else {
+		schemeResolvers[strings.ToLower(scheme)] = resolver
+	}
+}
+
+// schemeResolver returns the resolver registered for the scheme, if any
+func schemeResolver(scheme string) (SchemeResolver, bool) {
+	if scheme == "" {
+		return nil, false
+	}
+
+	schemeResolversMu.RLock()
+	defer schemeResolversMu.RUnlock()
+
+	resolver, ok := schemeResolvers[strings.ToLower(scheme)]
+	return resolver, ok
+}
+
+// hasSchemeResolver returns whether a resolver is registered for the scheme
+func hasSchemeResolver(scheme string) bool {
+	_, ok := schemeResolver(scheme)
+	return ok
+}
@@ -0,0 +1,53 @@
+package plugin
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegisterPluginScheme(t *testing.T) {
+	RegisterPluginScheme("artifactory", func(p *Plugin) (string, error) {
+		if p.Location == "" {
+			return "", errors.New("Missing plugin location")
+		}
+		return "https://artifactory.example.com/" + p.Location + ".git", nil
+	})
+	defer RegisterPluginScheme("artifactory", nil)
+
+	plugin, err := CreatePlugin("artifactory://plugins/docker-compose#v1.0.0", map[string]interface{}{})
+	assert.NoError(t, err)
+
+	repo, err := plugin.Repository()
+	assert.NoError(t, err)
+	assert.Equal(t, "https://artifactory.example.com/plugins/docker-compose.git", repo)
+	assert.Equal(t, PluginKindGit, plugin.Kind())
+
+	// Errors from the resolver are returned
+	_, err = (&Plugin{Scheme: "ARTIFACTORY"}).Repository()
+	assert.EqualError(t, err, "Missing plugin location")
+
+	// Other schemes still build the repository from the location
+	plugin, err = CreatePlugin("https://github.com/buildkite-plugins/docker-compose#v1.0.0", map[string]interface{}{})
+	assert.NoError(t, err)
+
+	repo, err = plugin.Repository()
+	assert.NoError(t, err)
+	assert.Equal(t, "https://github.com/buildkite-plugins/docker-compose", repo)
+}
+
+func TestRegisterPluginSchemeUnregisters(t *testing.T) {
+	RegisterPluginScheme("artifactory", func(p *Plugin) (string, error) {
+		return "https://artifactory.example.com/" + p.Location, nil
+	})
+	RegisterPluginScheme("artifactory", nil)
+
+	plugin, err := CreatePlugin("artifactory://plugins/docker-compose#v1.0.0", map[string]interface{}{})
+	assert.NoError(t, err)
+
+	repo, err := plugin.Repository()
+	assert.NoError(t, err)
+	assert.Equal(t, "artifactory://plugins/docker-compose", repo)
+	assert.Equal(t, PluginKindUnknown, plugin.Kind())
+}
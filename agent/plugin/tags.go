@@ -0,0 +1,68 @@
+package plugin
+
+import "sync"
+
+// TagLister lists the tags of a plugin repository, for example by running
+// `git ls-remote --tags`
+type TagLister func(repository string) ([]string, error)
+
+// TagCache stores the tags of plugin repositories, so they're only listed once
+// when several plugins come from the same repository
+type TagCache interface {
+	Get(repository string) ([]string, bool)
+	Set(repository string, tags []string)
+}
+
+// MemoryTagCache is a TagCache that keeps tags in memory, and is safe to use
+// from multiple goroutines
+type MemoryTagCache struct {
+	mu   sync.Mutex
+	tags map[string][]string
+}
+
+// NewMemoryTagCache returns an empty MemoryTagCache
+func NewMemoryTagCache() *MemoryTagCache {
+	return &MemoryTagCache{tags: map[string][]string{}}
+}
+
+func (c *MemoryTagCache) Get(repository string) ([]string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	tags, ok := c.tags[repository]
+	return tags, ok
+}
+
+func (c *MemoryTagCache) Set(repository string, tags []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.tags[repository] = tags
+}
+
+// Tags returns the tags of the plugin's repository. The cache is keyed by
+// Repository(), and is consulted before listing the tags and populated
+// afterwards. It can be nil to always list the tags.
+func (p *Plugin) Tags(list TagLister, cache TagCache) ([]string, error) {
+	repository, err := p.Repository()
+	if err != nil {
+		return nil, err
+	}
+
+	if cache != nil {
+		if tags, ok := cache.Get(repository); ok {
+			return tags, nil
+		}
+	}
+
+	tags, err := list(repository)
+	if err != nil {
+		return nil, err
+	}
+
+	if cache != nil {
+		cache.Set(repository, tags)
+	}
+
+	return tags, nil
+}
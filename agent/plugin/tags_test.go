@@ -0,0 +1,61 @@
+package plugin
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPluginTagsUsesCache(t *testing.T) {
+	t.Parallel()
+
+	var listed []string
+	list := func(repository string) ([]string, error) {
+		listed = append(listed, repository)
+		if repository == "https://github.com/buildkite-plugins/broken" {
+			return nil, errors.New("Repository not found")
+		}
+		return []string{"v1.0.0", "v1.1.0"}, nil
+	}
+
+	cache := NewMemoryTagCache()
+
+	for _, location := range []string{
+		"github.com/buildkite-plugins/docker-compose#v1.0.0",
+		"github.com/buildkite-plugins/docker-compose#v1.1.0",
+		"git.example.com/plugins.git/deploy",
+		"git.example.com/plugins.git/rollback",
+	} {
+		plugin, err := CreatePlugin(location, map[string]interface{}{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		tags, err := plugin.Tags(list, cache)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"v1.0.0", "v1.1.0"}, tags)
+	}
+
+	// Each repository is only listed once
+	assert.Equal(t, []string{
+		"https://github.com/buildkite-plugins/docker-compose",
+		"https://git.example.com/plugins.git",
+	}, listed)
+
+	tags, ok := cache.Get("https://git.example.com/plugins.git")
+	assert.True(t, ok)
+	assert.Equal(t, []string{"v1.0.0", "v1.1.0"}, tags)
+
+	// Errors aren't cached
+	broken := &Plugin{Location: "github.com/buildkite-plugins/broken"}
+	for i := 0; i < 2; i++ {
+		_, err := broken.Tags(list, cache)
+		assert.EqualError(t, err, "Repository not found")
+	}
+	assert.Len(t, listed, 4)
+
+	// Without a cache, the tags are always listed
+	_, err := broken.Tags(func(string) ([]string, error) { return nil, nil }, nil)
+	assert.NoError(t, err)
+}
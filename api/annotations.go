@@ -1,6 +1,10 @@
 package api
 
-import "fmt"
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
 
 // Annotation represents a Buildkite Agent API Annotation
 type Annotation struct {
@@ -8,18 +12,66 @@ type Annotation struct {
 	Context string `json:"context,omitempty"`
 	Style   string `json:"style,omitempty"`
 	Append  bool   `json:"append,omitempty"`
+
+	// Fail with a 404 rather than create the annotation if there isn't one
+	// with this context already
+	RequireExisting bool `json:"require_existing,omitempty"`
+
+	// The Content-Type of the request, which defaults to application/json.
+	// The body is always JSON.
+	ContentType string `json:"-"`
+}
+
+// AnnotationResponse is the annotation as created or updated by the API
+type AnnotationResponse struct {
+	ID  string `json:"id,omitempty"`
+	URL string `json:"url,omitempty"`
+}
+
+// Idempotency returns whether the annotation can be posted more than once.
+// Replacing an annotation always gives the same result, but appending to one
+// would add the body again each time it is retried, and the annotations
+// endpoint doesn't take an idempotency UUID to ignore repeats with.
+func (a *Annotation) Idempotency() Idempotency {
+	if a.Append {
+		return NotIdempotent
+	}
+	return Idempotent
+}
+
+// SafeToRetry returns whether posting the annotation can be retried
+func (a *Annotation) SafeToRetry() bool {
+	return a.Idempotency().SafeToRetry()
 }
 
 // Annotate a build in the Buildkite UI
-func (c *Client) Annotate(jobId string, annotation *Annotation) (*Response, error) {
+func (c *Client) Annotate(jobId string, annotation *Annotation) (*AnnotationResponse, *Response, error) {
 	u := fmt.Sprintf("jobs/%s/annotations", jobId)
 
 	req, err := c.newRequest("POST", u, annotation)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	return c.doRequest(req, nil)
+	if annotation.ContentType != "" {
+		req.Header.Set("Content-Type", annotation.ContentType)
+	}
+
+	// The response body may be empty, so it's only decoded if there is one
+	var body bytes.Buffer
+	resp, err := c.doRequest(req, &body)
+	if err != nil {
+		return nil, resp, err
+	}
+
+	a := new(AnnotationResponse)
+	if body.Len() > 0 {
+		if err := json.Unmarshal(body.Bytes(), a); err != nil {
+			return nil, resp, err
+		}
+	}
+
+	return a, resp, nil
 }
 
 // Remove an annotation from a build
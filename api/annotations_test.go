@@ -0,0 +1,45 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/buildkite/agent/v3/logger"
+)
+
+func TestAnnotationSafeToRetry(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		annotation Annotation
+		safe       bool
+	}{
+		{"replace", Annotation{Body: "llamas"}, true},
+		{"append", Annotation{Body: "llamas", Append: true}, false},
+	} {
+		if safe := tc.annotation.SafeToRetry(); safe != tc.safe {
+			t.Errorf("%s: expected SafeToRetry() to be %v, got %v", tc.name, tc.safe, safe)
+		}
+	}
+}
+
+func TestAnnotateResponse(t *testing.T) {
+	for _, body := range []string{``, `{"id":"llamas"}`} {
+		server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			rw.WriteHeader(http.StatusCreated)
+			fmt.Fprint(rw, body)
+		}))
+
+		c := NewClient(logger.Discard, Config{Endpoint: server.URL, Token: "llamas"})
+		a, _, err := c.Annotate("job", &Annotation{Body: "llamas"})
+		server.Close()
+
+		if err != nil {
+			t.Fatalf("Annotating with a response of %q failed: %v", body, err)
+		}
+		if body != "" && a.ID != "llamas" {
+			t.Errorf("Expected the ID from the response, got %q", a.ID)
+		}
+	}
+}
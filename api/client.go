@@ -4,6 +4,7 @@ package api
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"encoding/json"
 	"errors"
@@ -12,9 +13,10 @@ import (
 	"io/ioutil"
 	"net"
 	"net/http"
-	"net/http/httputil"
 	"net/url"
 	"reflect"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -23,8 +25,9 @@ import (
 )
 
 const (
-	defaultEndpoint  = "https://agent.buildkite.com/"
-	defaultUserAgent = "buildkite-agent/api"
+	defaultEndpoint       = "https://agent.buildkite.com/"
+	defaultUserAgent      = "buildkite-agent/api"
+	defaultConnectTimeout = 30 * time.Second
 )
 
 // Config is configuration for the API Client
@@ -33,6 +36,11 @@ type Config struct {
 	// The URL should always be specified with a trailing slash.
 	Endpoint string
 
+	// A path prefixed to the path of every API request, for when the API is
+	// behind a reverse proxy that serves it under a path, so that the endpoint
+	// can be just the proxy's host. Leading and trailing slashes are ignored.
+	PathPrefix string
+
 	// The authentication token to use, either a registration or access token
 	Token string
 
@@ -45,6 +53,14 @@ type Config struct {
 	// If true, requests and responses will be dumped and set to the logger
 	DebugHTTP bool
 
+	// If true, requests other than GET and HEAD are logged rather than
+	// sent, and get an empty successful response
+	DryRun bool
+
+	// How long to wait for a connection to the API to be established,
+	// including the TLS handshake. Defaults to 30 seconds.
+	ConnectTimeout time.Duration
+
 	// The http client used, leave nil for the default
 	HTTPClient *http.Client
 }
@@ -59,6 +75,14 @@ type Client struct {
 
 	// The logger used
 	logger logger.Logger
+
+	// The attempt of a retry loop this client is being used for, which is
+	// included in HTTP debug logging
+	attempt int
+
+	// Requests are cancelled if they're still running at this time, unless
+	// it's zero
+	deadline time.Time
 }
 
 // NewClient returns a new Buildkite Agent API Client.
@@ -71,6 +95,10 @@ func NewClient(l logger.Logger, conf Config) *Client {
 		conf.UserAgent = defaultUserAgent
 	}
 
+	if conf.ConnectTimeout == 0 {
+		conf.ConnectTimeout = defaultConnectTimeout
+	}
+
 	httpClient := conf.HTTPClient
 	if conf.HTTPClient == nil {
 		t := &http.Transport{
@@ -78,12 +106,12 @@ func NewClient(l logger.Logger, conf Config) *Client {
 			DisableCompression: false,
 			DisableKeepAlives:  false,
 			DialContext: (&net.Dialer{
-				Timeout:   30 * time.Second,
+				Timeout:   conf.ConnectTimeout,
 				KeepAlive: 30 * time.Second,
 			}).DialContext,
 			MaxIdleConns:        100,
 			IdleConnTimeout:     90 * time.Second,
-			TLSHandshakeTimeout: 30 * time.Second,
+			TLSHandshakeTimeout: conf.ConnectTimeout,
 		}
 
 		if conf.DisableHTTP2 {
@@ -111,6 +139,22 @@ func (c *Client) Config() Config {
 	return c.conf
 }
 
+// WithAttempt returns a copy of the client that tags its HTTP debug logging
+// with the attempt number of a retry loop
+func (c *Client) WithAttempt(attempt int) *Client {
+	clone := *c
+	clone.attempt = attempt
+	return &clone
+}
+
+// WithDeadline returns a copy of the client that cancels requests that are
+// still running at the deadline
+func (c *Client) WithDeadline(deadline time.Time) *Client {
+	clone := *c
+	clone.deadline = deadline
+	return &clone
+}
+
 // FromAgentRegisterResponse returns a new instance using the access token and endpoint
 // from the registration response
 func (c *Client) FromAgentRegisterResponse(resp *AgentRegisterResponse) *Client {
@@ -145,7 +189,7 @@ func (c *Client) FromPing(resp *Ping) *Client {
 // specified, the value pointed to by body is JSON encoded and included as the
 // request body.
 func (c *Client) newRequest(method, urlStr string, body interface{}) (*http.Request, error) {
-	u := joinURLPath(c.conf.Endpoint, urlStr)
+	u := joinURLPath(c.conf.Endpoint, c.conf.PathPrefix, urlStr)
 
 	buf := new(bytes.Buffer)
 	if body != nil {
@@ -174,7 +218,7 @@ func (c *Client) newRequest(method, urlStr string, body interface{}) (*http.Requ
 // of the Client. Relative URLs should always be specified without a preceding
 // slash.
 func (c *Client) newFormRequest(method, urlStr string, body *bytes.Buffer) (*http.Request, error) {
-	u := joinURLPath(c.conf.Endpoint, urlStr)
+	u := joinURLPath(c.conf.Endpoint, c.conf.PathPrefix, urlStr)
 
 	req, err := http.NewRequest(method, u, body)
 	if err != nil {
@@ -200,6 +244,33 @@ func newResponse(r *http.Response) *Response {
 	return response
 }
 
+// RetryAfter returns how long a 429 Too Many Requests response asked for the
+// request to be retried after. The Retry-After header can be either a number
+// of seconds or a HTTP date.
+func (r *Response) RetryAfter() (time.Duration, bool) {
+	if r == nil || r.StatusCode != http.StatusTooManyRequests {
+		return 0, false
+	}
+
+	header := r.Header.Get("Retry-After")
+	if header == "" {
+		return 0, false
+	}
+
+	if seconds, err := strconv.Atoi(header); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+
+	if t, err := http.ParseTime(header); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d, true
+		}
+		return 0, true
+	}
+
+	return 0, false
+}
+
 // Do sends an API request and returns the API response. The API response is
 // JSON decoded and stored in the value pointed to by v, or returned as an
 // error if an API error has occurred.  If v implements the io.Writer
@@ -209,22 +280,27 @@ func (c *Client) doRequest(req *http.Request, v interface{}) (*Response, error)
 	var err error
 
 	if c.conf.DebugHTTP {
-		// If the request is a multi-part form, then it's probably a
-		// file upload, in which case we don't want to spewing out the
-		// file contents into the debug log (especially if it's been
-		// gzipped)
-		var requestDump []byte
-		if strings.Contains(req.Header.Get("Content-Type"), "multipart/form-data") {
-			requestDump, err = httputil.DumpRequestOut(req, false)
-		} else {
-			requestDump, err = httputil.DumpRequestOut(req, true)
-		}
+		c.debugRequest(req)
+	}
 
-		if err != nil {
-			c.logger.Debug("ERR: %s\n%s", err, string(requestDump))
-		} else {
-			c.logger.Debug("%s", string(requestDump))
-		}
+	if c.conf.DryRun && req.Method != http.MethodGet && req.Method != http.MethodHead {
+		c.logger.Info("Dry run, not sending %s %s", req.Method, req.URL)
+		return newResponse(&http.Response{
+			Status:     "200 OK",
+			StatusCode: http.StatusOK,
+			Proto:      "HTTP/1.1",
+			ProtoMajor: 1,
+			ProtoMinor: 1,
+			Header:     http.Header{},
+			Body:       ioutil.NopCloser(strings.NewReader("")),
+			Request:    req,
+		}), nil
+	}
+
+	if !c.deadline.IsZero() {
+		ctx, cancel := context.WithDeadline(req.Context(), c.deadline)
+		defer cancel()
+		req = req.WithContext(ctx)
 	}
 
 	ts := time.Now()
@@ -233,6 +309,9 @@ func (c *Client) doRequest(req *http.Request, v interface{}) (*Response, error)
 
 	resp, err := c.client.Do(req)
 	if err != nil {
+		if c.conf.DebugHTTP {
+			c.logger.Debug("%s✗ %s %s: %s", c.debugAttemptPrefix(), req.Method, req.URL, c.redactDebugHTTP(err.Error()))
+		}
 		return nil, err
 	}
 
@@ -248,12 +327,7 @@ func (c *Client) doRequest(req *http.Request, v interface{}) (*Response, error)
 	response := newResponse(resp)
 
 	if c.conf.DebugHTTP {
-		responseDump, err := httputil.DumpResponse(resp, true)
-		if err != nil {
-			c.logger.Debug("\nERR: %s\n%s", err, string(responseDump))
-		} else {
-			c.logger.Debug("\n%s", string(responseDump))
-		}
+		c.debugResponse(req, resp)
 	}
 
 	err = checkResponse(resp)
@@ -278,6 +352,102 @@ func (c *Client) doRequest(req *http.Request, v interface{}) (*Response, error)
 	return response, err
 }
 
+// The most of a request or response body that's included in HTTP debug logging
+const debugHTTPBodyLimit = 4096
+
+// Headers that carry credentials, and so are redacted from HTTP debug logging
+// along with any header with "auth" or "token" in its name
+var debugHTTPRedactedHeaders = []string{"Cookie", "Set-Cookie"}
+
+// debugRequest logs the request's method, URL, headers and the start of its
+// body, with credentials redacted
+func (c *Client) debugRequest(req *http.Request) {
+	var body []byte
+
+	// If the request is a multi-part form, then it's probably a file
+	// upload, in which case we don't want to spewing out the file contents
+	// into the debug log (especially if it's been gzipped)
+	if req.GetBody != nil && !strings.Contains(req.Header.Get("Content-Type"), "multipart/form-data") {
+		if r, err := req.GetBody(); err == nil {
+			body, _ = ioutil.ReadAll(r)
+		}
+	}
+
+	c.logger.Debug("%s→ %s %s\n%s", c.debugAttemptPrefix(), req.Method, req.URL,
+		c.redactDebugHTTP(debugHeaders(req.Header)+debugBody(body)))
+}
+
+// debugResponse logs the response's status, headers and the start of its
+// body, with credentials redacted. The body is replaced so it can still be
+// read afterwards.
+func (c *Client) debugResponse(req *http.Request, resp *http.Response) {
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		c.logger.Debug("%sERR: Failed to read response body: %s", c.debugAttemptPrefix(), err)
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	c.logger.Debug("%s← %s %s %s\n%s", c.debugAttemptPrefix(), req.Method, req.URL, resp.Status,
+		c.redactDebugHTTP(debugHeaders(resp.Header)+debugBody(body)))
+}
+
+func (c *Client) debugAttemptPrefix() string {
+	if c.attempt == 0 {
+		return ""
+	}
+	return fmt.Sprintf("[Attempt %d] ", c.attempt)
+}
+
+// redactDebugHTTP removes the client's token from HTTP debug logging
+func (c *Client) redactDebugHTTP(s string) string {
+	if c.conf.Token == "" {
+		return s
+	}
+	return strings.Replace(s, c.conf.Token, "[REDACTED]", -1)
+}
+
+func debugHeaders(header http.Header) string {
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	for _, name := range names {
+		value := strings.Join(header[name], ", ")
+		if isRedactedHeader(name) {
+			value = "[REDACTED]"
+		}
+		fmt.Fprintf(&b, "%s: %s\n", name, value)
+	}
+
+	return b.String()
+}
+
+func isRedactedHeader(name string) bool {
+	lower := strings.ToLower(name)
+	if strings.Contains(lower, "auth") || strings.Contains(lower, "token") {
+		return true
+	}
+	for _, redacted := range debugHTTPRedactedHeaders {
+		if strings.EqualFold(name, redacted) {
+			return true
+		}
+	}
+	return false
+}
+
+func debugBody(body []byte) string {
+	if len(body) == 0 {
+		return ""
+	}
+	if len(body) > debugHTTPBodyLimit {
+		return fmt.Sprintf("\n%s... (%d more bytes)", body[:debugHTTPBodyLimit], len(body)-debugHTTPBodyLimit)
+	}
+	return "\n" + string(body)
+}
+
 // ErrorResponse provides a message.
 type ErrorResponse struct {
 	Response *http.Response // HTTP response that caused this error
@@ -332,6 +502,9 @@ func addOptions(s string, opt interface{}) (string, error) {
 	return u.String(), nil
 }
 
-func joinURLPath(endpoint string, path string) string {
+func joinURLPath(endpoint string, prefix string, path string) string {
+	if prefix = strings.Trim(prefix, "/"); prefix != "" {
+		path = prefix + "/" + strings.TrimLeft(path, "/")
+	}
 	return strings.TrimRight(endpoint, "/") + "/" + strings.TrimLeft(path, "/")
 }
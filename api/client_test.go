@@ -1,10 +1,15 @@
 package api
 
 import (
+	"bytes"
 	"fmt"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/buildkite/agent/v3/logger"
 )
@@ -73,3 +78,228 @@ func checkAuthToken(t *testing.T, req *http.Request, token string) bool {
 	}
 	return true
 }
+
+func TestDebugHTTPRedactsCredentials(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("X-Session-Token", "session-secret")
+		rw.WriteHeader(http.StatusOK)
+		fmt.Fprintf(rw, `{"echo":"llamas"}`)
+	}))
+	defer server.Close()
+
+	l := logger.NewBuffer()
+	c := NewClient(l, Config{
+		Endpoint:  server.URL,
+		Token:     "llamas",
+		DebugHTTP: true,
+	}).WithAttempt(2)
+
+	req, err := c.newRequest("POST", "ping", map[string]string{"token": "llamas"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Custom-Auth", "alpacas")
+
+	if _, err := c.doRequest(req, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	var requestLog, responseLog string
+	for _, msg := range l.Messages {
+		if strings.HasPrefix(msg, "[debug] [Attempt 2] → POST") {
+			requestLog = msg
+		}
+		if strings.HasPrefix(msg, "[debug] [Attempt 2] ← POST") {
+			responseLog = msg
+		}
+	}
+
+	if !strings.Contains(requestLog, "X-Custom-Auth: [REDACTED]") || !strings.Contains(requestLog, `{"token":"[REDACTED]"}`) {
+		t.Errorf("Request wasn't redacted: %q", requestLog)
+	}
+
+	if !strings.Contains(responseLog, "200 OK") || !strings.Contains(responseLog, "X-Session-Token: [REDACTED]") || !strings.Contains(responseLog, `{"echo":"[REDACTED]"}`) {
+		t.Errorf("Response wasn't redacted: %q", responseLog)
+	}
+
+	for _, msg := range l.Messages {
+		if strings.Contains(msg, "llamas") || strings.Contains(msg, "alpacas") || strings.Contains(msg, "session-secret") {
+			t.Errorf("Credentials leaked into the log: %q", msg)
+		}
+	}
+}
+
+func TestConnectTimeout(t *testing.T) {
+	// A listener that never accepts, so the TLS handshake hangs until the
+	// timeout
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	c := NewClient(logger.Discard, Config{
+		Endpoint:       "https://" + ln.Addr().String() + "/",
+		Token:          "llamas",
+		ConnectTimeout: 100 * time.Millisecond,
+	})
+
+	req, err := c.newRequest("GET", "ping", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	if _, err := c.doRequest(req, nil); err == nil {
+		t.Fatal("Expected the request to fail")
+	}
+
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Request took %s to fail, expected it to give up after the connect timeout", elapsed)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Retry-After", req.URL.Query().Get("after"))
+		http.Error(rw, `{"message":"Slow down"}`, http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+
+	c := NewClient(logger.Discard, Config{
+		Endpoint: server.URL,
+		Token:    "llamas",
+	})
+
+	for after, expected := range map[string]time.Duration{
+		"2": 2 * time.Second,
+		time.Now().Add(-time.Minute).UTC().Format(http.TimeFormat): 0,
+	} {
+		req, err := c.newRequest("GET", "ping?after="+url.QueryEscape(after), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resp, err := c.doRequest(req, nil)
+		if err == nil {
+			t.Fatal("Expected a 429 error")
+		}
+
+		retryAfter, ok := resp.RetryAfter()
+		if !ok {
+			t.Fatalf("Expected Retry-After %q to be honored", after)
+		}
+		if retryAfter != expected {
+			t.Errorf("Expected Retry-After %q to be %s, got %s", after, expected, retryAfter)
+		}
+	}
+
+	// Other statuses don't have a Retry-After
+	resp := &Response{&http.Response{StatusCode: http.StatusServiceUnavailable, Header: http.Header{"Retry-After": []string{"2"}}}}
+	if _, ok := resp.RetryAfter(); ok {
+		t.Error("Expected Retry-After to be ignored for a 503")
+	}
+}
+
+func TestDryRunDoesntSendChanges(t *testing.T) {
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		requests = append(requests, req.Method+" "+req.URL.Path)
+		rw.WriteHeader(http.StatusOK)
+		fmt.Fprintf(rw, `{"key":"llamas","value":"alpacas"}`)
+	}))
+	defer server.Close()
+
+	l := logger.NewBuffer()
+	c := NewClient(l, Config{
+		Endpoint: server.URL,
+		Token:    "llamas",
+		DryRun:   true,
+	})
+
+	_, resp, err := c.Annotate("my-job", &Annotation{Body: "llamas"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected a synthetic success, got %d", resp.StatusCode)
+	}
+
+	if _, err := c.AnnotationRemove("my-job", "default"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reads are still sent
+	if _, _, err := c.GetJobState("my-job"); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(requests) != 1 || requests[0] != "GET /jobs/my-job" {
+		t.Errorf("Expected only the read to be sent, got %v", requests)
+	}
+
+	if !strings.Contains(strings.Join(l.Messages, "\n"), "[info] Dry run, not sending POST") {
+		t.Errorf("Expected the dry run to be logged, got %v", l.Messages)
+	}
+}
+
+func TestPathPrefix(t *testing.T) {
+	var paths []string
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		paths = append(paths, req.URL.Path)
+		rw.WriteHeader(http.StatusOK)
+		fmt.Fprintf(rw, `{}`)
+	}))
+	defer server.Close()
+
+	for _, tc := range []struct {
+		endpoint string
+		prefix   string
+	}{
+		{server.URL, "buildkite/v3"},
+		{server.URL + "/", "/buildkite/v3/"},
+		{server.URL, "//buildkite/v3"},
+	} {
+		c := NewClient(logger.Discard, Config{
+			Endpoint:   tc.endpoint,
+			PathPrefix: tc.prefix,
+			Token:      "llamas",
+		})
+
+		req, err := c.newRequest("GET", "jobs/my-job", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := c.doRequest(req, nil); err != nil {
+			t.Fatal(err)
+		}
+
+		req, err = c.newFormRequest("POST", "/jobs/my-job/artifacts", &bytes.Buffer{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := c.doRequest(req, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Without a prefix the path is used as is
+	c := NewClient(logger.Discard, Config{Endpoint: server.URL + "/v3/", Token: "llamas"})
+	req, err := c.newRequest("GET", "jobs/my-job", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.doRequest(req, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		"/buildkite/v3/jobs/my-job", "/buildkite/v3/jobs/my-job/artifacts",
+		"/buildkite/v3/jobs/my-job", "/buildkite/v3/jobs/my-job/artifacts",
+		"/buildkite/v3/jobs/my-job", "/buildkite/v3/jobs/my-job/artifacts",
+		"/v3/jobs/my-job",
+	}
+	if strings.Join(paths, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Expected request paths %v, got %v", expected, paths)
+	}
+}
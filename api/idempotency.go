@@ -0,0 +1,21 @@
+package api
+
+// Idempotency describes whether an API call can be safely retried
+type Idempotency int
+
+const (
+	// Idempotent calls have the same effect no matter how many times they
+	// are made, so they can always be retried
+	Idempotent Idempotency = iota
+
+	// NotIdempotent calls may be applied more than once if they're retried
+	// after failing, so they're only retried when the API says they weren't
+	// applied, like when they're rate limited
+	NotIdempotent
+)
+
+// SafeToRetry returns whether a call with this idempotency can be retried
+// after any failure
+func (i Idempotency) SafeToRetry() bool {
+	return i == Idempotent
+}
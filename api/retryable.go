@@ -1,6 +1,7 @@
 package api
 
 import (
+	"errors"
 	"io"
 	"net"
 	"net/url"
@@ -54,3 +55,16 @@ func IsRetryableError(err error) bool {
 
 	return false
 }
+
+// IsPermanentNetworkError returns true if the error is a connection related
+// error that retrying won't fix, like a host that doesn't exist because the
+// endpoint is misconfigured. Timeouts and failures the resolver says are
+// temporary aren't permanent.
+func IsPermanentNetworkError(err error) bool {
+	var dnserr *net.DNSError
+	if errors.As(err, &dnserr) {
+		return dnserr.IsNotFound && !dnserr.IsTimeout && !dnserr.IsTemporary
+	}
+
+	return false
+}
@@ -0,0 +1,73 @@
+package api
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestIsPermanentNetworkError(t *testing.T) {
+	dialError := func(err error) error {
+		return &url.Error{
+			Op:  "Post",
+			URL: "https://agent.buildkite.localhost/v3/register",
+			Err: &net.OpError{Op: "dial", Net: "tcp", Err: err},
+		}
+	}
+
+	for _, tc := range []struct {
+		name      string
+		err       error
+		permanent bool
+		retryable bool
+	}{
+		{
+			"no such host",
+			dialError(&net.DNSError{Err: "no such host", Name: "agent.buildkite.localhost", IsNotFound: true}),
+			true, true,
+		},
+		{
+			"dns timeout",
+			dialError(&net.DNSError{Err: "i/o timeout", Name: "agent.buildkite.localhost", IsTimeout: true}),
+			false, true,
+		},
+		{
+			"temporary dns failure",
+			dialError(&net.DNSError{Err: "server misbehaving", Name: "agent.buildkite.localhost", IsTemporary: true}),
+			false, true,
+		},
+		{
+			"connection reset",
+			dialError(os.NewSyscallError("read", syscall.ECONNRESET)),
+			false, true,
+		},
+		{
+			"connection refused",
+			dialError(os.NewSyscallError("connect", syscall.ECONNREFUSED)),
+			false, true,
+		},
+		{
+			"unexpected eof",
+			&url.Error{Op: "Post", URL: "https://agent.buildkite.localhost/v3/register", Err: io.ErrUnexpectedEOF},
+			false, true,
+		},
+		{
+			"other error",
+			errors.New("llamas"),
+			false, false,
+		},
+	} {
+		if permanent := IsPermanentNetworkError(tc.err); permanent != tc.permanent {
+			t.Errorf("%s: expected IsPermanentNetworkError to be %v, got %v", tc.name, tc.permanent, permanent)
+		}
+
+		// Permanent errors are still retryable for long running loops
+		if retryable := IsRetryableError(tc.err); retryable != tc.retryable {
+			t.Errorf("%s: expected IsRetryableError to be %v, got %v", tc.name, tc.retryable, retryable)
+		}
+	}
+}
@@ -651,12 +651,41 @@ func (b *Bootstrap) preparePlugins() error {
 		}
 	}
 
-	var err error
-	b.plugins, err = plugin.CreateFromJSON(b.Config.Plugins)
-	if err != nil {
+	// The repository hasn't been checked out yet, so configuration files
+	// can't be read from it
+	plugins, err := plugin.CreateFromJSON(b.Config.Plugins)
+	if err == plugin.ErrConfigFileWithoutBaseDir {
+		return fmt.Errorf("Plugins can't use %s in a pipeline, as plugins are set up before the repository is checked out", plugin.ConfigFileKey)
+	} else if err != nil {
 		return errors.Wrap(err, "Failed to parse a plugin definition")
 	}
 
+	// Skip any plugins whose condition doesn't match the environment
+	b.plugins = nil
+	for _, p := range plugins {
+		run, err := p.ShouldRun(b.shell.Env)
+		if err != nil {
+			return errors.Wrapf(err, "Failed to evaluate the condition for plugin %s", p.Name())
+		}
+
+		if !run {
+			b.shell.Commentf("Skipping plugin %s as its condition %q is false", p.Name(), p.Condition)
+			continue
+		}
+
+		// Fail early rather than run a plugin on an agent it doesn't work with
+		satisfied, err := p.SatisfiesAgentVersion(agent.Version())
+		if err != nil {
+			return errors.Wrapf(err, "Failed to check the agent version required by plugin %s", p.Name())
+		}
+
+		if !satisfied {
+			return fmt.Errorf("Plugin %s requires agent version %s, but this agent is version %s", p.Name(), p.RequiredAgentVersion, agent.Version())
+		}
+
+		b.plugins = append(b.plugins, p)
+	}
+
 	if b.Debug {
 		b.shell.Commentf("Parsed %d plugins", len(b.plugins))
 	}
@@ -808,7 +837,15 @@ func (b *Bootstrap) executePluginHook(ctx context.Context, name string, checkout
 			return err
 		}
 
-		env, _ := p.ConfigurationToEnvironment()
+		env, warnings, err := p.ConfigurationToEnvironmentWithOptions(plugin.EnvironmentOptions{})
+		if err != nil {
+			return errors.Wrapf(err, "Failed to convert the configuration of plugin %s to environment variables", p.Plugin.Name())
+		}
+
+		for _, warning := range warnings {
+			b.shell.Warningf("%s", warning)
+		}
+
 		if err := b.executeHook(ctx, "plugin", p.Plugin.Name()+" "+name, hookPath, env); err != nil {
 			return err
 		}
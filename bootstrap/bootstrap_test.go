@@ -2,8 +2,12 @@ package bootstrap
 
 import (
 	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 
+	"github.com/buildkite/agent/v3/agent/plugin"
 	"github.com/buildkite/agent/v3/bootstrap/shell"
 	"github.com/opentracing/opentracing-go"
 	"github.com/stretchr/testify/assert"
@@ -93,3 +97,30 @@ func TestStartTracing(t *testing.T) {
 	stopper()
 	assert.Equal(t, span, opentracing.SpanFromContext(ctx))
 }
+
+func TestExecutePluginHookFailsOnInvalidConfiguration(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "plugin-hooks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "environment"), []byte("#!/bin/bash\nexit 0\n"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := plugin.CreatePlugin("github.com/buildkite-plugins/docker-compose#v1.0", map[string]interface{}{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A value that can't be turned into a variable, which would otherwise
+	// run the hook without any of the plugin's variables
+	p.Configuration["run"] = struct{}{}
+
+	b := &Bootstrap{}
+	err = b.executePluginHook(context.Background(), "environment", []*pluginCheckout{{Plugin: p, HooksDir: dir}})
+	assert.EqualError(t, err, "Failed to convert the configuration of plugin docker-compose to environment variables: Unknown type struct {} {}")
+}
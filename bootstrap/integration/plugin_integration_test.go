@@ -10,6 +10,7 @@ import (
 	"strings"
 	"testing"
 
+	"github.com/buildkite/agent/v3/agent/plugin"
 	"github.com/buildkite/agent/v3/bootstrap/shell"
 	"github.com/buildkite/bintest/v3"
 )
@@ -208,8 +209,164 @@ func TestOverlappingPluginHooks(t *testing.T) {
 	tester.RunAndCheck(t, env...)
 }
 
+func TestPluginConfigFilesFailTheJob(t *testing.T) {
+	t.Parallel()
+
+	tester, err := NewBootstrapTester()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tester.Close()
+
+	pluginMock := tester.MustMock(t, "my-plugin")
+
+	p := createTestPlugin(t, map[string][]string{
+		"environment": []string{
+			"#!/bin/bash",
+			pluginMock.Path + " testing",
+		},
+	})
+	p.config = map[string]interface{}{"_config_file": "docker.json"}
+
+	json, err := p.ToJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The hook is never run
+	pluginMock.Expect("testing").NotCalled()
+
+	err = tester.Run(t, `BUILDKITE_PLUGINS=`+json)
+	if err == nil {
+		t.Fatal("Expected the bootstrap to fail")
+	}
+
+	if !strings.Contains(tester.Output, "Plugins can't use _config_file in a pipeline") {
+		t.Fatalf("Expected the output to explain the failure, got %s", tester.Output)
+	}
+
+	tester.CheckMocks(t)
+}
+
+func TestPluginsWithClashingConfigurationKeysStillRun(t *testing.T) {
+	t.Parallel()
+
+	tester, err := NewBootstrapTester()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tester.Close()
+
+	pluginMock := tester.MustMock(t, "my-plugin")
+
+	p := createTestPlugin(t, map[string][]string{
+		"environment": []string{
+			"#!/bin/bash",
+			pluginMock.Path + " testing",
+		},
+	})
+
+	// Both keys become the same variable, which isn't an error by default
+	p.config = map[string]interface{}{"myKey": "alpacas", "MYKEY": "llamas"}
+
+	json, err := p.ToJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pluginMock.Expect("testing").Once().AndExitWith(0)
+
+	tester.RunAndCheck(t, `BUILDKITE_PLUGINS=`+json)
+}
+
+func TestPluginConfigurationOverTheLimitsFailsTheJob(t *testing.T) {
+	t.Parallel()
+
+	tester, err := NewBootstrapTester()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tester.Close()
+
+	pluginMock := tester.MustMock(t, "my-plugin")
+
+	p := createTestPlugin(t, map[string][]string{
+		"environment": []string{
+			"#!/bin/bash",
+			pluginMock.Path + " testing",
+		},
+	})
+
+	mounts := make([]interface{}, plugin.DefaultConfigMaxListLength+1)
+	for i := range mounts {
+		mounts[i] = ""
+	}
+	p.config = map[string]interface{}{"mounts": mounts}
+
+	json, err := p.ToJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The hook is never run
+	pluginMock.Expect("testing").NotCalled()
+
+	err = tester.Run(t, `BUILDKITE_PLUGINS=`+json)
+	if err == nil {
+		t.Fatal("Expected the bootstrap to fail")
+	}
+
+	if !strings.Contains(tester.Output, `Plugin configuration key "mounts" has 10001 items, which is more than the limit of 10000`) {
+		t.Fatalf("Expected the output to explain the failure, got %s", tester.Output)
+	}
+
+	tester.CheckMocks(t)
+}
+
+func TestPluginsRequiringANewerAgentFailTheJob(t *testing.T) {
+	t.Parallel()
+
+	tester, err := NewBootstrapTester()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tester.Close()
+
+	pluginMock := tester.MustMock(t, "my-plugin")
+
+	p := createTestPlugin(t, map[string][]string{
+		"environment": []string{
+			"#!/bin/bash",
+			pluginMock.Path + " testing",
+		},
+	})
+	p.config = map[string]interface{}{"_requires": ">=999"}
+
+	json, err := p.ToJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The hook is never run
+	pluginMock.Expect("testing").NotCalled()
+
+	err = tester.Run(t, `BUILDKITE_PLUGINS=`+json)
+	if err == nil {
+		t.Fatal("Expected the bootstrap to fail")
+	}
+
+	if !strings.Contains(tester.Output, "requires agent version >=999, but this agent is version") {
+		t.Fatalf("Expected the output to explain the failure, got %s", tester.Output)
+	}
+
+	tester.CheckMocks(t)
+}
+
 type testPlugin struct {
 	*gitRepository
+
+	// The plugin's configuration, which defaults to a single setting
+	config map[string]interface{}
 }
 
 func createTestPlugin(t *testing.T, hooks map[string][]string) *testPlugin {
@@ -237,7 +394,7 @@ func createTestPlugin(t *testing.T, hooks map[string][]string) *testPlugin {
 		t.Fatal(err)
 	}
 
-	return &testPlugin{repo}
+	return &testPlugin{gitRepository: repo}
 }
 
 // ToJSON turns a single testPlugin into a single-item JSON
@@ -260,10 +417,15 @@ func (tp *testPlugin) MarshalJSON() ([]byte, error) {
 	}
 	normalizedPath := strings.TrimPrefix(strings.Replace(tp.Path, "\\", "/", -1), "/")
 
-	p := map[string]interface{}{
-		fmt.Sprintf(`file:///%s#%s`, normalizedPath, strings.TrimSpace(commitHash)): map[string]string{
+	config := tp.config
+	if config == nil {
+		config = map[string]interface{}{
 			"settings": "blah",
-		},
+		}
+	}
+
+	p := map[string]interface{}{
+		fmt.Sprintf(`file:///%s#%s`, normalizedPath, strings.TrimSpace(commitHash)): config,
 	}
 	b, err := json.Marshal(&p)
 	if err != nil {
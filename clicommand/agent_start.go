@@ -104,14 +104,16 @@ type AgentStartConfig struct {
 	// Global flags
 	Debug       bool     `cli:"debug"`
 	NoColor     bool     `cli:"no-color"`
+	Color       string   `cli:"color"`
 	Experiments []string `cli:"experiment" normalize:"list"`
 	Profile     string   `cli:"profile"`
 
 	// API config
-	DebugHTTP bool   `cli:"debug-http"`
-	Token     string `cli:"token" validate:"required"`
-	Endpoint  string `cli:"endpoint" validate:"required"`
-	NoHTTP2   bool   `cli:"no-http2"`
+	DebugHTTP          bool   `cli:"debug-http"`
+	Token              string `cli:"token" validate:"required"`
+	Endpoint           string `cli:"endpoint" validate:"required"`
+	EndpointPathPrefix string `cli:"endpoint-path-prefix"`
+	NoHTTP2            bool   `cli:"no-http2"`
 
 	// Deprecated
 	NoSSHFingerprintVerification bool     `cli:"no-automatic-ssh-fingerprint-verification" deprecated-and-renamed-to:"NoSSHKeyscan"`
@@ -451,11 +453,13 @@ var AgentStartCommand = cli.Command{
 		// API Flags
 		AgentRegisterTokenFlag,
 		EndpointFlag,
+		EndpointPathPrefixFlag,
 		NoHTTP2Flag,
 		DebugHTTPFlag,
 
 		// Global flags
 		NoColorFlag,
+		ColorFlag,
 		DebugFlag,
 		ExperimentsFlag,
 		ProfileFlag,
@@ -1,14 +1,29 @@
 package clicommand
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
 	"io/ioutil"
+	"mime"
+	"net/url"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/buildkite/agent/v3/stdin"
 
 	"github.com/buildkite/agent/v3/api"
-	"github.com/buildkite/agent/v3/cliconfig"
+	"github.com/buildkite/agent/v3/logger"
 	"github.com/buildkite/agent/v3/retry"
 	"github.com/urfave/cli"
 )
@@ -30,41 +45,180 @@ Description:
    Annotations are written in CommonMark-compliant Markdown, with "GitHub
    Flavored Markdown" extensions.
 
-   The annotation body can be supplied as a command line argument, or by piping
-   content into the command.
+   The annotation body can be supplied as a command line argument, read from a
+   file with --file, or by piping content into the command. With --tail, only
+   the last lines of the file are used.
 
    You can update an existing annotation's body by running the annotate command
    again and provide the same context as the one you want to update. Or if you
    leave context blank, it will use the default context.
 
+   Annotations are replaced by default, which can be stated explicitly with
+   --replace. Use --append to add to the body of the annotation with the
+   context, which creates it if it doesn't exist yet. To add to an annotation
+   that must already exist, such as one made by another tool, use
+   --append-to-context, which fails if there's no annotation with that context.
+   Appends are only tried once, unless they're rate limited, as an append that
+   failed may have still been applied and retrying it could add the body twice.
+
    You can also update only the style of an existing annotation by omitting the
    body entirely and providing a new style value.
 
+   The style can be read from a file with --style-from-file, such as one a
+   test run wrote its exit code to in an earlier step. The file can contain an
+   exit code, where 0 is success and anything else is error, or a style name.
+
+   With --input-json, the input from --file or STDIN is read as a JSON object
+   with body, style and context fields, all of which are optional, and any
+   of --style and --context that are given take precedence over the fields.
+
+   The body can be cleaned up with --transform, which can be given more than
+   once to apply transforms in order. The transforms are trim, which removes
+   leading and trailing whitespace, dedent, which removes indentation that
+   every line has in common, and collapse-blanks, which collapses runs of
+   blank lines into a single blank line.
+
+   With --exec, the arguments after the flags are a command that's run, and
+   its output is used as the body. The style is success if the command exits
+   with 0 and error otherwise, unless --style is given. Anything the command
+   writes to STDERR is logged rather than annotated, only the first 1MB of its
+   output is kept, and annotating doesn't fail because the command did. With
+   --deadline, the command is killed if it's still running at the deadline.
+
+   With --no-stdin, STDIN is never read, even if it looks readable, so the
+   body must be given as an argument or with --file.
+
+   With --details-summary, the body is wrapped in a collapsible <details>
+   block, with the given text as the summary that's shown when it's collapsed.
+
+   With --alert, the body is wrapped in a GitHub style alert block of the
+   given type, like > [!WARNING], which is shown as a quote where alerts
+   aren't supported. It's independent of --style, which styles the whole
+   annotation.
+
+   With --prefix, the given Markdown is added before the body, separated by a
+   blank line, such as a header line that every annotation in a pipeline should
+   start with. When appending, it's only added if the job hasn't already added
+   it to the annotation with that context, as the existing annotation can't be
+   read, and it's never added with --append-to-context.
+
+   With --table, the body is read as tab separated values and turned into a
+   Markdown table, using the first row as the table's headers.
+
+   With --context-from, the context is a hash of a comma separated list of
+   values, such as "$OS,$ARCH,$RUBY" in a matrix build, so that each
+   combination of values gets its own annotation. Whitespace around each value
+   is ignored, and empty values still count, so "linux,,3.1" and "linux,3.1"
+   are different contexts.
+
+   Contexts can only contain letters, numbers and the characters - _ . : and
+   /. With --sanitize-context replace, runs of any other characters are
+   replaced with a - and the change is logged. With --sanitize-context
+   reject, a context with any other characters is an error.
+
+   Content from untrusted sources can be escaped with --escape so that it's
+   shown as plain text. With --escape html, the characters <, >, &, ' and "
+   are replaced with HTML entities, so HTML can't be injected but Markdown
+   formatting still applies. With --escape markdown, every ASCII punctuation
+   character is escaped with a backslash, so neither Markdown nor HTML is
+   interpreted.
+
+   With --once-per-step, the contexts a job has posted are recorded in a file
+   named buildkite-annotate-<job id> in the state directory, and later
+   attempts to post the same context from that job are skipped.
+
+   With --if-changed, a hash of the style and body posted to each context is
+   recorded in a file named buildkite-annotate-<job id>-hashes in the state
+   directory, and the annotation is only posted if it differs from the last
+   one this job posted to that context. If the file doesn't exist the
+   annotation is always posted.
+
+   With --max-append-size, the number of bytes each job has appended to each
+   context is recorded in a file named buildkite-annotate-<job id>-appended in
+   the state directory, and once another append would take it past the limit
+   the append is skipped and logged rather than failing the step.
+
+   The state directory is .buildkite-annotate in the job's checkout path,
+   unless another one is given with --state-dir, such as a tmpfs that's
+   cleaned up after each job. It's created if it doesn't exist, and only the
+   agent's user can read it. State files that are symlinks are never followed.
+
+   With --status-file, the HTTP status of the request that annotates the build
+   is written to a file once it's finished, whether or not it succeeded, or 0
+   if the API couldn't be reached. Nothing is written if the annotation is
+   skipped before it's sent.
+
+   With --check-job-state, the job's state is checked before annotating, and
+   if the job has already finished the annotation is either skipped, with
+   --check-job-state skip, or is an error, with --check-job-state fail.
+
 Example:
 
    $ buildkite-agent annotate "All tests passed! :rocket:"
    $ cat annotation.md | buildkite-agent annotate --style "warning"
    $ buildkite-agent annotate --style "success" --context "junit"
-   $ ./script/dynamic_annotation_generator | buildkite-agent annotate --style "success"`
+   $ ./script/dynamic_annotation_generator | buildkite-agent annotate --style "success"
+   $ cat results.tsv | buildkite-agent annotate --table --context "results"
+   $ buildkite-agent annotate --file build.log --tail 50 --style "error"
+   $ buildkite-agent annotate --context "lint" --exec -- make lint`
 
 type AnnotateConfig struct {
-	Body    string `cli:"arg:0" label:"annotation body"`
-	Style   string `cli:"style"`
-	Context string `cli:"context"`
-	Append  bool   `cli:"append"`
-	Job     string `cli:"job" validate:"required"`
+	Body          string   `cli:"arg:0" label:"annotation body"`
+	File          string   `cli:"file" normalize:"filepath"`
+	Tail          int      `cli:"tail"`
+	InputJSON     bool     `cli:"input-json"`
+	Style         string   `cli:"style"`
+	StyleFile     string   `cli:"style-from-file" normalize:"filepath"`
+	Context       string   `cli:"context"`
+	Append        bool     `cli:"append"`
+	Replace       bool     `cli:"replace"`
+	AppendTo      string   `cli:"append-to-context"`
+	PrintResult   bool     `cli:"print-result"`
+	PrintBody     bool     `cli:"print-body"`
+	Table         bool     `cli:"table"`
+	Details       string   `cli:"details-summary"`
+	Alert         string   `cli:"alert"`
+	Prefix        string   `cli:"prefix"`
+	Escape        string   `cli:"escape"`
+	Transforms    []string `cli:"transform" normalize:"list"`
+	OncePerStep   bool     `cli:"once-per-step"`
+	IfChanged     bool     `cli:"if-changed"`
+	StateDir      string   `cli:"state-dir" normalize:"filepath"`
+	CheckoutPath  string   `cli:"checkout-path" normalize:"filepath"`
+	MaxAppendSize int      `cli:"max-append-size"`
+	StdinTimeout  string   `cli:"stdin-timeout"`
+	NoStdin       bool     `cli:"no-stdin"`
+	Exec          bool     `cli:"exec"`
+	Deadline      string   `cli:"deadline"`
+	ContextHash   bool     `cli:"context-hash"`
+	ContextFrom   string   `cli:"context-from"`
+	ContextPrefix string   `cli:"context-prefix"`
+	Sanitize      string   `cli:"sanitize-context"`
+	StatusFile    string   `cli:"status-file" normalize:"filepath"`
+	ContentType   string   `cli:"content-type"`
+	CheckJobState string   `cli:"check-job-state"`
+	Job           string   `cli:"job" validate:"required"`
+
+	// The command to run with --exec, which is all of the arguments
+	ExecArgs []string
 
 	// Global flags
 	Debug       bool     `cli:"debug"`
 	NoColor     bool     `cli:"no-color"`
+	Color       string   `cli:"color"`
 	Experiments []string `cli:"experiment" normalize:"list"`
 	Profile     string   `cli:"profile"`
+	DumpConfig  bool     `cli:"dump-config"`
 
 	// API config
-	DebugHTTP        bool   `cli:"debug-http"`
-	AgentAccessToken string `cli:"agent-access-token" validate:"required"`
-	Endpoint         string `cli:"endpoint" validate:"required"`
-	NoHTTP2          bool   `cli:"no-http2"`
+	DebugHTTP          bool   `cli:"debug-http"`
+	AgentAccessToken   string `cli:"agent-access-token"`
+	TokenFromKeyring   string `cli:"token-from-keyring"`
+	Endpoint           string `cli:"endpoint" validate:"required"`
+	EndpointPathPrefix string `cli:"endpoint-path-prefix"`
+	NoHTTP2            bool   `cli:"no-http2"`
+	ConnectTimeout     string `cli:"connect-timeout"`
+	DryRun             bool   `cli:"dry-run"`
 }
 
 var AnnotateCommand = cli.Command{
@@ -82,11 +236,158 @@ var AnnotateCommand = cli.Command{
 			Usage:  "The style of the annotation (`success`, `info`, `warning` or `error`)",
 			EnvVar: "BUILDKITE_ANNOTATION_STYLE",
 		},
+		cli.StringFlag{
+			Name:   "style-from-file",
+			Usage:  "Read the style of the annotation from a file containing an exit code, where 0 is `success` and anything else is `error`, or a style name. Can't be used with --style",
+			EnvVar: "BUILDKITE_ANNOTATION_STYLE_FROM_FILE",
+		},
+		cli.StringFlag{
+			Name:   "file",
+			Usage:  "Read the annotation body from a file",
+			EnvVar: "BUILDKITE_ANNOTATION_FILE",
+		},
+		cli.BoolFlag{
+			Name:   "input-json",
+			Usage:  "Read the annotation's body, style and context from a JSON object given with --file or on STDIN. The --style and --context flags take precedence over the fields in the object",
+			EnvVar: "BUILDKITE_ANNOTATION_INPUT_JSON",
+		},
+		cli.IntFlag{
+			Name:   "tail",
+			Usage:  "Only use the last `n` lines of the file given with --file",
+			EnvVar: "BUILDKITE_ANNOTATION_TAIL",
+		},
+		cli.BoolFlag{
+			Name:   "context-hash",
+			Usage:  "Use a hash of the annotation body as the context, so identical bodies update the same annotation. Can't be used with --context or --append",
+			EnvVar: "BUILDKITE_ANNOTATION_CONTEXT_HASH",
+		},
+		cli.StringFlag{
+			Name:   "context-from",
+			Usage:  "Use a hash of a comma separated list of `values` as the context, such as \"$OS,$ARCH\" for each cell of a matrix build. Can't be used with --context or --context-hash",
+			EnvVar: "BUILDKITE_ANNOTATION_CONTEXT_FROM",
+		},
+		cli.StringFlag{
+			Name:   "context-prefix",
+			Usage:  "A prefix added to the context of the annotation, including the default context, to keep it apart from annotations made by others",
+			EnvVar: "BUILDKITE_ANNOTATION_CONTEXT_PREFIX",
+		},
+		cli.StringFlag{
+			Name:   "sanitize-context",
+			Usage:  "Check the context for characters that aren't allowed, and either `replace` them or `reject` the context",
+			EnvVar: "BUILDKITE_ANNOTATION_SANITIZE_CONTEXT",
+		},
 		cli.BoolFlag{
 			Name:   "append",
-			Usage:  "Append to the body of an existing annotation",
+			Usage:  "Append to the body of an existing annotation. Appends aren't retried when they fail, unless they're rate limited",
 			EnvVar: "BUILDKITE_ANNOTATION_APPEND",
 		},
+		cli.StringFlag{
+			Name:   "append-to-context",
+			Usage:  "Append to the body of the existing annotation with this context, and fail if there isn't one. Can't be used with --context or --replace",
+			EnvVar: "BUILDKITE_ANNOTATION_APPEND_TO_CONTEXT",
+		},
+		cli.BoolFlag{
+			Name:   "replace",
+			Usage:  "Replace the body of an existing annotation, which is the default. Can't be used with --append",
+			EnvVar: "BUILDKITE_ANNOTATION_REPLACE",
+		},
+		cli.StringFlag{
+			Name:   "details-summary",
+			Usage:  "Wrap the annotation body in a collapsible <details> block, with this `text` as the summary that's shown when it's collapsed",
+			EnvVar: "BUILDKITE_ANNOTATION_DETAILS_SUMMARY",
+		},
+		cli.StringFlag{
+			Name:   "alert",
+			Usage:  "Wrap the annotation body in an alert block, either `note`, `tip`, `important`, `warning` or `caution`, which is shown as a quote where alerts aren't supported",
+			EnvVar: "BUILDKITE_ANNOTATION_ALERT",
+		},
+		cli.StringFlag{
+			Name:   "prefix",
+			Usage:  "Markdown, like a header line, that's added before the body, separated by a blank line. Appends only add it if this job hasn't already added it to the annotation, and --append-to-context never does",
+			EnvVar: "BUILDKITE_ANNOTATION_PREFIX",
+		},
+		cli.BoolFlag{
+			Name:   "table",
+			Usage:  "Read the annotation body as tab separated values and render it as a Markdown table, using the first row as the headers",
+			EnvVar: "BUILDKITE_ANNOTATION_TABLE",
+		},
+		cli.StringSliceFlag{
+			Name:   "transform",
+			Value:  &cli.StringSlice{},
+			Usage:  "Clean up the annotation body with a transform, either `trim`, `dedent` or `collapse-blanks`. Can be given more than once, and the transforms are applied in order",
+			EnvVar: "BUILDKITE_ANNOTATION_TRANSFORM",
+		},
+		cli.StringFlag{
+			Name:   "escape",
+			Usage:  "Escape the annotation body so it's shown as plain text, either `html` or `markdown`",
+			EnvVar: "BUILDKITE_ANNOTATION_ESCAPE",
+		},
+		cli.BoolFlag{
+			Name:   "print-result",
+			Usage:  "Print the resulting annotation as JSON, including its context, style, and any ID or URL returned by the API",
+			EnvVar: "BUILDKITE_ANNOTATION_PRINT_RESULT",
+		},
+		cli.BoolFlag{
+			Name:   "print-body",
+			Usage:  "Log the annotation body that's sent, after it's been transformed and escaped, as a record in the job log",
+			EnvVar: "BUILDKITE_ANNOTATION_PRINT_BODY",
+		},
+		cli.BoolFlag{
+			Name:   "once-per-step",
+			Usage:  "Only post an annotation with this context once per job, and skip any later attempts. The contexts that have been posted are tracked in a file named after the job in the state directory",
+			EnvVar: "BUILDKITE_ANNOTATION_ONCE_PER_STEP",
+		},
+		cli.BoolFlag{
+			Name:   "if-changed",
+			Usage:  "Only post the annotation if its style or body has changed since this job last posted to the context. Can't be used with --append",
+			EnvVar: "BUILDKITE_ANNOTATION_IF_CHANGED",
+		},
+		cli.IntFlag{
+			Name:   "max-append-size",
+			Usage:  "Skip appending once this job would have appended more than this many `bytes` to the annotation, to stop a loop from growing it until it's rejected. Requires --append or --append-to-context",
+			EnvVar: "BUILDKITE_ANNOTATION_MAX_APPEND_SIZE",
+		},
+		cli.StringFlag{
+			Name:   "state-dir",
+			Usage:  "The directory that --once-per-step, --if-changed and --max-append-size keep track of what each job has posted in, which is created if it doesn't exist. Defaults to .buildkite-annotate in the --checkout-path",
+			EnvVar: "BUILDKITE_ANNOTATION_STATE_DIR",
+		},
+		cli.StringFlag{
+			Name:   "checkout-path",
+			Usage:  "The path the job's repository is checked out to, which the default --state-dir is in",
+			EnvVar: "BUILDKITE_BUILD_CHECKOUT_PATH",
+		},
+		cli.DurationFlag{
+			Name:   "stdin-timeout",
+			Usage:  "How long to wait for the annotation body to be read from STDIN before giving up. By default it waits forever",
+			EnvVar: "BUILDKITE_ANNOTATION_STDIN_TIMEOUT",
+		},
+		cli.BoolFlag{
+			Name:   "no-stdin",
+			Usage:  "Never read the annotation body from STDIN, for when STDIN looks readable but isn't, and require a body argument or --file instead",
+			EnvVar: "BUILDKITE_ANNOTATION_NO_STDIN",
+		},
+		cli.BoolFlag{
+			Name:   "exec",
+			Usage:  "Run the command given as the arguments, like --exec -- make test, and use its output as the annotation body, and its exit status as the style unless --style is given",
+			EnvVar: "BUILDKITE_ANNOTATION_EXEC",
+		},
+		cli.DurationFlag{
+			Name:   "deadline",
+			Usage:  "How long to spend posting the annotation, including retries. Requests still running at the deadline are cancelled and retries that would start after it are skipped, so set this to less than the step's timeout to see why annotating failed. The step's timeout isn't used, as how much of it is left isn't known",
+			EnvVar: "BUILDKITE_ANNOTATION_DEADLINE",
+		},
+		cli.StringFlag{
+			Name:   "content-type",
+			Value:  "application/json",
+			Usage:  "The Content-Type of the request to the Agent API, for endpoints or proxies that route on it. The body is always JSON",
+			EnvVar: "BUILDKITE_ANNOTATION_CONTENT_TYPE",
+		},
+		cli.StringFlag{
+			Name:   "check-job-state",
+			Usage:  "Check the job is still running before annotating, and either `skip` the annotation or `fail` if it isn't",
+			EnvVar: "BUILDKITE_ANNOTATION_CHECK_JOB_STATE",
+		},
 		cli.StringFlag{
 			Name:   "job",
 			Value:  "",
@@ -96,83 +397,1077 @@ var AnnotateCommand = cli.Command{
 
 		// API Flags
 		AgentAccessTokenFlag,
+		TokenFromKeyringFlag,
 		EndpointFlag,
+		EndpointPathPrefixFlag,
 		NoHTTP2Flag,
+		ConnectTimeoutFlag,
 		DebugHTTPFlag,
+		DryRunFlag,
+		StatusFileFlag,
 
 		// Global flags
 		NoColorFlag,
+		ColorFlag,
 		DebugFlag,
 		ExperimentsFlag,
 		ProfileFlag,
+		DumpConfigFlag,
 	},
 	Action: func(c *cli.Context) {
 		// The configuration will be loaded into this struct
 		cfg := AnnotateConfig{}
 
-		l := CreateLogger(&cfg)
+		runAPICommand(c, &cfg, func(l logger.Logger) error {
+			cfg.ExecArgs = c.Args()
+			return annotate(cfg, l, os.Stdout)
+		})
+	},
+}
+
+func annotate(cfg AnnotateConfig, l logger.Logger, out io.Writer) error {
+	var body string
+	var err error
+
+	// Work out the deadline before anything else, so reading the body
+	// counts towards it
+	var deadline time.Time
+	if d := cfg.Deadline; d != "" {
+		timeout, err := time.ParseDuration(d)
+		if err != nil {
+			return fmt.Errorf("Failed to parse deadline: %v", err)
+		}
+		if timeout > 0 {
+			deadline = time.Now().Add(timeout)
+		}
+	}
 
-		// Load the configuration
-		if err := cliconfig.Load(c, l, &cfg); err != nil {
-			l.Fatal("%s", err)
+	if cfg.Replace && cfg.Append {
+		return fmt.Errorf("--replace can't be used with --append")
+	}
+
+	// Appending to an existing context is an append that mustn't create a
+	// new annotation
+	if cfg.AppendTo != "" {
+		if cfg.Context != "" {
+			return fmt.Errorf("--append-to-context can't be used with --context")
+		}
+		if cfg.Replace {
+			return fmt.Errorf("--append-to-context can't be used with --replace")
+		}
+		if cfg.ContextHash {
+			return fmt.Errorf("--append-to-context can't be used with --context-hash")
 		}
+		if cfg.ContextFrom != "" {
+			return fmt.Errorf("--append-to-context can't be used with --context-from")
+		}
+		cfg.Context = cfg.AppendTo
+		cfg.Append = true
+	}
 
-		// Setup any global configuration options
-		done := HandleGlobalFlags(l, cfg)
-		defer done()
+	if cfg.ContextFrom != "" {
+		if cfg.Context != "" {
+			return fmt.Errorf("--context-from can't be used with --context")
+		}
+		if cfg.ContextHash {
+			return fmt.Errorf("--context-from can't be used with --context-hash")
+		}
 
-		var body string
-		var err error
+		cfg.Context = annotationContextFromValues(cfg.ContextFrom)
+		l.Debug("Using context %q from the values %q", cfg.Context, cfg.ContextFrom)
+	}
+
+	if cfg.ContentType != "" {
+		if mediaType, _, err := mime.ParseMediaType(cfg.ContentType); err != nil || !strings.Contains(mediaType, "/") {
+			return fmt.Errorf("Invalid --content-type %q, expected a MIME type like application/json", cfg.ContentType)
+		}
+	}
+
+	switch cfg.CheckJobState {
+	case "", "skip", "fail":
+	default:
+		return fmt.Errorf("Unknown --check-job-state %q, expected skip or fail", cfg.CheckJobState)
+	}
+
+	if cfg.MaxAppendSize < 0 {
+		return fmt.Errorf("--max-append-size must be a positive number of bytes")
+	}
+	if cfg.MaxAppendSize > 0 && !cfg.Append {
+		return fmt.Errorf("--max-append-size requires --append or --append-to-context")
+	}
+
+	if cfg.StyleFile != "" {
+		if cfg.Style != "" {
+			return fmt.Errorf("--style-from-file can't be used with --style")
+		}
+		if cfg.Style, err = annotationStyleFromFile(cfg.StyleFile); err != nil {
+			return err
+		}
+		l.Debug("Using style %q from %s", cfg.Style, cfg.StyleFile)
+	}
+
+	if cfg.Tail < 0 {
+		return fmt.Errorf("--tail must be a positive number of lines")
+	}
+	if cfg.Tail > 0 && cfg.File == "" {
+		return fmt.Errorf("--tail requires --file")
+	}
+
+	if cfg.NoStdin && cfg.File == "" && cfg.Body == "" {
+		return fmt.Errorf("--no-stdin requires an annotation body argument or --file")
+	}
+
+	if cfg.Exec {
+		if len(cfg.ExecArgs) == 0 {
+			return fmt.Errorf("--exec requires a command to run, like --exec -- make test")
+		}
+		if cfg.File != "" {
+			return fmt.Errorf("--exec can't be used with --file")
+		}
+		if cfg.InputJSON {
+			return fmt.Errorf("--exec can't be used with --input-json")
+		}
+		if cfg.StyleFile != "" {
+			return fmt.Errorf("--exec can't be used with --style-from-file")
+		}
 
+		var style string
+		if body, style, err = runAnnotationCommand(l, cfg.ExecArgs, maxAnnotationExecOutput, deadline); err != nil {
+			return err
+		}
+		if cfg.Style == "" {
+			cfg.Style = style
+		}
+	} else if cfg.File != "" {
 		if cfg.Body != "" {
-			body = cfg.Body
-		} else if stdin.IsReadable() {
-			l.Info("Reading annotation body from STDIN")
+			return fmt.Errorf("--file can't be used with an annotation body argument")
+		}
+
+		b, err := ioutil.ReadFile(cfg.File)
+		if err != nil {
+			return fmt.Errorf("Failed to read annotation body from %s: %v", cfg.File, err)
+		}
+
+		body = string(b)
+		if cfg.Tail > 0 {
+			body = lastLines(body, cfg.Tail)
+		}
+	} else if cfg.Body != "" {
+		body = cfg.Body
+	} else if !cfg.NoStdin && stdin.IsReadable() {
+		l.Info("Reading annotation body from STDIN")
 
-			// Actually read the file from STDIN
-			stdin, err := ioutil.ReadAll(os.Stdin)
+		var stdinTimeout time.Duration
+		if t := cfg.StdinTimeout; t != "" {
+			stdinTimeout, err = time.ParseDuration(t)
 			if err != nil {
-				l.Fatal("Failed to read from STDIN: %s", err)
+				return fmt.Errorf("Failed to parse stdin timeout: %v", err)
 			}
+		}
+
+		// Actually read the file from STDIN
+		stdin, err := readAllWithTimeout(os.Stdin, stdinTimeout)
+		if err != nil {
+			return fmt.Errorf("Failed to read from STDIN: %s", err)
+		}
+
+		body = string(stdin[:])
+	}
+
+	if cfg.InputJSON {
+		if cfg.Body != "" {
+			return fmt.Errorf("--input-json can't be used with an annotation body argument")
+		}
+		if strings.TrimSpace(body) == "" {
+			return fmt.Errorf("--input-json requires a JSON object from --file or STDIN")
+		}
+
+		input, err := parseAnnotationInput(body)
+		if err != nil {
+			return err
+		}
+
+		body = input.Body
+		if cfg.Style == "" {
+			cfg.Style = input.Style
+		}
+		if cfg.Context == "" {
+			cfg.Context = input.Context
+		}
+	}
+
+	for _, name := range cfg.Transforms {
+		transform, ok := annotationTransforms[name]
+		if !ok {
+			return fmt.Errorf("Unknown --transform %q, expected trim, dedent or collapse-blanks", name)
+		}
+		body = transform(body)
+	}
+
+	if cfg.Escape != "" {
+		if cfg.Table {
+			return fmt.Errorf("--escape can't be used with --table")
+		}
+		if body, err = escapeAnnotationBody(cfg.Escape, body); err != nil {
+			return err
+		}
+	}
 
-			body = string(stdin[:])
+	if cfg.Table {
+		if body == "" {
+			return fmt.Errorf("--table requires an annotation body")
 		}
+		body = markdownTableFromTSV(body)
+	}
 
-		// Create the API client
-		client := api.NewClient(l, loadAPIClientConfig(cfg, `AgentAccessToken`))
+	if cfg.Details != "" {
+		if body == "" {
+			return fmt.Errorf("--details-summary requires an annotation body")
+		}
+		body = detailsBlock(cfg.Details, body)
+	}
 
-		// Create the annotation we'll send to the Buildkite API
-		annotation := &api.Annotation{
-			Body:    body,
-			Style:   cfg.Style,
-			Context: cfg.Context,
-			Append:  cfg.Append,
+	if cfg.Alert != "" {
+		if body == "" {
+			return fmt.Errorf("--alert requires an annotation body")
+		}
+		if body, err = alertBlock(cfg.Alert, body); err != nil {
+			return err
 		}
+	}
 
-		// Retry the annotation a few times before giving up
-		err = retry.Do(func(s *retry.Stats) error {
-			// Attempt to create the annotation
-			resp, err := client.Annotate(cfg.Job, annotation)
+	// Content addressed contexts replace the annotation with the same body,
+	// so there is nothing to append to
+	if cfg.ContextHash {
+		if cfg.Context != "" {
+			return fmt.Errorf("--context-hash can't be used with --context")
+		}
+		if cfg.Append {
+			return fmt.Errorf("--context-hash can't be used with --append")
+		}
+		if body == "" {
+			return fmt.Errorf("--context-hash requires an annotation body")
+		}
+
+		cfg.Context = annotationContextFromBody(body)
+		l.Debug("Using context %q from the annotation body", cfg.Context)
+	}
+
+	cfg.Context = prefixAnnotationContext(cfg.ContextPrefix, cfg.Context)
 
-			// Don't bother retrying if the response was one of these statuses
-			if resp != nil && (resp.StatusCode == 401 || resp.StatusCode == 404 || resp.StatusCode == 400) {
-				s.Break()
-				return err
+	if cfg.Sanitize != "" && cfg.Context != "" {
+		sanitized := sanitizeAnnotationContext(cfg.Context)
+
+		switch cfg.Sanitize {
+		case "replace":
+			if sanitized == "" {
+				return fmt.Errorf("The annotation context %q has no allowed characters", cfg.Context)
+			}
+			if sanitized != cfg.Context {
+				l.Info("Replaced characters that aren't allowed in the annotation context %q, using %q", cfg.Context, sanitized)
+				cfg.Context = sanitized
 			}
+		case "reject":
+			if sanitized != cfg.Context {
+				return fmt.Errorf("The annotation context %q contains characters that aren't allowed, it can only contain letters, numbers and - _ . : /", cfg.Context)
+			}
+		default:
+			return fmt.Errorf("Unknown --sanitize-context %q, expected replace or reject", cfg.Sanitize)
+		}
+	}
+
+	var stateDir string
+	if cfg.OncePerStep || cfg.IfChanged || cfg.MaxAppendSize > 0 || cfg.Prefix != "" {
+		if stateDir, err = annotationStateDir(cfg.StateDir, cfg.CheckoutPath); err != nil {
+			return fmt.Errorf("Failed to create the annotation state directory: %s", err)
+		}
+	}
+
+	// If we've been asked to only post each context once per step, check
+	// whether this job has already posted it
+	var statePath string
+	if cfg.OncePerStep {
+		statePath = annotationStatePath(stateDir, cfg.Job)
+
+		posted, err := hasPostedAnnotationContext(statePath, cfg.Context)
+		if err != nil {
+			return fmt.Errorf("Failed to read annotation state from %s: %s", statePath, err)
+		}
+
+		if posted {
+			l.Info("An annotation with this context has already been posted by this job, skipping")
+			return nil
+		}
+	}
+
+	// Skip posting the same annotation to a context twice in a row
+	var hashStatePath, hash string
+	if cfg.IfChanged {
+		if cfg.Append {
+			return fmt.Errorf("--if-changed can't be used with --append")
+		}
+
+		hashStatePath = annotationHashStatePath(stateDir, cfg.Job)
+		hash = annotationHash(cfg.Style, body)
+
+		lastHash, err := lastAnnotationHash(hashStatePath, cfg.Context)
+		if err != nil {
+			return fmt.Errorf("Failed to read annotation state from %s: %s", hashStatePath, err)
+		}
 
-			// Show the unexpected error
+		if lastHash == hash {
+			l.Info("The annotation hasn't changed since it was last posted by this job, skipping")
+			return nil
+		}
+	}
+
+	// Only add the prefix once when appending. The existing annotation can't
+	// be read, so this relies on the job recording where it's added it.
+	var prefixStatePath string
+	addPrefix := cfg.Prefix != "" && body != "" && cfg.AppendTo == ""
+	if addPrefix {
+		prefixStatePath = annotationPrefixStatePath(stateDir, cfg.Job)
+
+		if cfg.Append {
+			prefixed, err := hasPostedAnnotationContext(prefixStatePath, cfg.Context)
 			if err != nil {
-				l.Warn("%s (%s)", err, s)
+				return fmt.Errorf("Failed to read annotation state from %s: %s", prefixStatePath, err)
 			}
+			addPrefix = !prefixed
+		}
+	}
 
-			return err
-		}, &retry.Config{Maximum: 5, Interval: 1 * time.Second, Jitter: true})
+	if addPrefix {
+		body = cfg.Prefix + "\n\n" + body
+	}
+
+	// Stop appending once this job has appended as much as it's allowed to,
+	// counting the prefix as it's part of what's appended. Losing a line of an annotation shouldn't fail the step, so it isn't an
+	// error.
+	var appendStatePath string
+	if cfg.MaxAppendSize > 0 {
+		appendStatePath = annotationAppendStatePath(stateDir, cfg.Job)
 
-		// Show a fatal error if we gave up trying to create the annotation
+		appended, err := appendedAnnotationSize(appendStatePath, cfg.Context)
 		if err != nil {
-			l.Fatal("Failed to annotate build: %s", err)
+			return fmt.Errorf("Failed to read annotation state from %s: %s", appendStatePath, err)
 		}
 
-		l.Debug("Successfully annotated build")
-	},
+		if appended+len(body) > cfg.MaxAppendSize {
+			l.Info("Appending %d bytes would take this job past the --max-append-size of %d bytes, as it's already appended %d bytes to this annotation, skipping",
+				len(body), cfg.MaxAppendSize, appended)
+			return nil
+		}
+	}
+
+	// Create the API client
+	client, err := newAPIClient(l, cfg, "annotate")
+	if err != nil {
+		return err
+	}
+
+	// Cancel requests that are still running at the deadline, rather than
+	// only checking it between attempts
+	if !deadline.IsZero() {
+		client = client.WithDeadline(deadline)
+	}
+
+	// Don't bother annotating a job that has already finished
+	if cfg.CheckJobState != "" {
+		var state *api.JobState
+		err = retryAPIRequest(l, apiRetryOptions{Deadline: deadline}, func(s *retry.Stats) (*api.Response, error) {
+			var resp *api.Response
+			var err error
+			state, resp, err = client.WithAttempt(s.Attempt).GetJobState(cfg.Job)
+			return resp, err
+		})
+		if err != nil {
+			return fmt.Errorf("Failed to get the job's state: %s", err)
+		}
+
+		if !isActiveJobState(state.State) {
+			if cfg.CheckJobState == "fail" {
+				return fmt.Errorf("The job is %s, so it can't be annotated", state.State)
+			}
+			l.Info("The job is %s, skipping the annotation", state.State)
+			return nil
+		}
+	}
+
+	// Create the annotation we'll send to the Buildkite API
+	annotation := newAnnotation(cfg, body)
+
+	if cfg.PrintBody {
+		l.Info("Annotating with the body:\n%s", body)
+	}
+
+	// Retry the annotation a few times before giving up, but don't retry
+	// anything that could be applied twice
+	retryOpts := apiRetryOptions{
+		SingleAttempt: !annotation.SafeToRetry(),
+		Deadline:      deadline,
+	}
+
+	var result *api.AnnotationResponse
+	var resp *api.Response
+	err = retryAPIRequest(l, retryOpts, func(s *retry.Stats) (*api.Response, error) {
+		// Attempt to create the annotation
+		var err error
+		result, resp, err = client.WithAttempt(s.Attempt).Annotate(cfg.Job, annotation)
+		return resp, err
+	})
+
+	// Record the status for scripts, whether or not annotating worked. A dry
+	// run doesn't annotate anything, so there's no status to record.
+	if cfg.StatusFile != "" && !cfg.DryRun {
+		if statusErr := writeStatusFile(cfg.StatusFile, resp); statusErr != nil && err == nil {
+			return fmt.Errorf("Failed to write status to %s: %s", cfg.StatusFile, statusErr)
+		}
+	}
+
+	// Show a fatal error if we gave up trying to create the annotation
+	if err != nil && annotation.RequireExisting && resp != nil && resp.StatusCode == 404 {
+		return fmt.Errorf("Failed to annotate build: there's no annotation with the context %q to append to", cfg.Context)
+	} else if err != nil {
+		return fmt.Errorf("Failed to annotate build: %s", err)
+	}
+
+	// A dry run mustn't be recorded in the state, or later real runs would
+	// behave as if it had been posted
+	if cfg.DryRun {
+		l.Info("Dry run, not recording the annotation's state")
+	}
+
+	if cfg.OncePerStep && !cfg.DryRun {
+		if err := recordPostedAnnotationContext(statePath, cfg.Context); err != nil {
+			return fmt.Errorf("Failed to write annotation state to %s: %s", statePath, err)
+		}
+	}
+
+	if cfg.IfChanged && !cfg.DryRun {
+		if err := recordAnnotationHash(hashStatePath, cfg.Context, hash); err != nil {
+			return fmt.Errorf("Failed to write annotation state to %s: %s", hashStatePath, err)
+		}
+	}
+
+	if cfg.MaxAppendSize > 0 && !cfg.DryRun {
+		if err := recordAppendedAnnotationSize(appendStatePath, cfg.Context, len(body)); err != nil {
+			return fmt.Errorf("Failed to write annotation state to %s: %s", appendStatePath, err)
+		}
+	}
+
+	if addPrefix && !cfg.DryRun {
+		if err := recordPostedAnnotationContext(prefixStatePath, cfg.Context); err != nil {
+			return fmt.Errorf("Failed to write annotation state to %s: %s", prefixStatePath, err)
+		}
+	}
+
+	l.Debug("Successfully annotated build")
+
+	if cfg.PrintResult {
+		if err := printAnnotationResult(out, annotation, result); err != nil {
+			return fmt.Errorf("Failed to print annotation result: %s", err)
+		}
+	}
+
+	return nil
+}
+
+// newAnnotation creates the annotation to send to the Buildkite API. Without
+// a body, the body is left out of the request so that only the style of the
+// existing annotation is updated.
+func newAnnotation(cfg AnnotateConfig, body string) *api.Annotation {
+	return &api.Annotation{
+		Body:            body,
+		Style:           cfg.Style,
+		Context:         cfg.Context,
+		Append:          cfg.Append,
+		RequireExisting: cfg.AppendTo != "",
+		ContentType:     cfg.ContentType,
+	}
+}
+
+// isActiveJobState returns whether a job in this state hasn't finished yet
+func isActiveJobState(state string) bool {
+	switch state {
+	case "assigned", "accepted", "running":
+		return true
+	default:
+		return false
+	}
+}
+
+var annotationStyles = []string{"success", "info", "warning", "error"}
+
+// annotationStyleFromFile reads an annotation style from a file, which can
+// contain an exit code or the name of a style
+func annotationStyleFromFile(path string) (string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("Failed to read annotation style from %s: %v", path, err)
+	}
+
+	contents := strings.TrimSpace(string(b))
+
+	if code, err := strconv.Atoi(contents); err == nil {
+		if code == 0 {
+			return "success", nil
+		}
+		return "error", nil
+	}
+
+	for _, style := range annotationStyles {
+		if contents == style {
+			return style, nil
+		}
+	}
+
+	return "", fmt.Errorf("Failed to read annotation style from %s: expected an exit code or one of %s, got %q", path, strings.Join(annotationStyles, ", "), contents)
+}
+
+// maxAnnotationExecOutput is how much of the output of a command run with
+// --exec is kept, which is about as large an annotation as the API accepts
+const maxAnnotationExecOutput = 1024 * 1024
+
+// runAnnotationCommand runs a command for --exec, and returns its output as the
+// annotation body and the style for its exit status. What it writes to STDERR
+// is logged, and output past the limit is dropped. A command that runs but
+// fails isn't an error, as its output is still worth annotating, but one that's
+// killed for running past the deadline is.
+func runAnnotationCommand(l logger.Logger, args []string, limit int, deadline time.Time) (string, string, error) {
+	stdout := &limitedBuffer{limit: limit}
+	stderr := &limitedBuffer{limit: limit}
+
+	ctx := context.Background()
+	if !deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
+	}
+
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	// The arguments aren't logged, as they could contain secrets
+	l.Info("Running %s for the annotation body", args[0])
+	err := cmd.Run()
+
+	if ctx.Err() == context.DeadlineExceeded {
+		return "", "", fmt.Errorf("%s didn't finish before the deadline", args[0])
+	}
+
+	if stderr.Len() > 0 {
+		l.Info("%s wrote to STDERR:\n%s", args[0], strings.TrimRight(stderr.String(), "\n"))
+	}
+	if stdout.truncated {
+		l.Warn("Only the first %d bytes of the output of %s were kept for the annotation body", limit, args[0])
+	}
+
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil:
+		return stdout.String(), "success", nil
+	case errors.As(err, &exitErr):
+		l.Info("%s exited with status %d", args[0], exitErr.ExitCode())
+		return stdout.String(), "error", nil
+	default:
+		return "", "", fmt.Errorf("Failed to run %s: %v", args[0], err)
+	}
+}
+
+// limitedBuffer keeps the first limit bytes written to it and drops the rest,
+// without failing the writes so that the writer keeps going. It doesn't embed
+// a bytes.Buffer, as io.Copy would use its ReadFrom and skip the limit.
+type limitedBuffer struct {
+	buf       bytes.Buffer
+	limit     int
+	truncated bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if room := b.limit - b.buf.Len(); len(p) > room {
+		b.truncated = true
+		if room > 0 {
+			b.buf.Write(p[:room])
+		}
+		return len(p), nil
+	}
+	return b.buf.Write(p)
+}
+
+func (b *limitedBuffer) Len() int {
+	return b.buf.Len()
+}
+
+func (b *limitedBuffer) String() string {
+	return b.buf.String()
+}
+
+// printAnnotationResult writes the annotation that was posted, along with
+// what the API returned for it, as JSON
+func printAnnotationResult(out io.Writer, annotation *api.Annotation, result *api.AnnotationResponse) error {
+	output := struct {
+		Context string `json:"context"`
+		Style   string `json:"style,omitempty"`
+		*api.AnnotationResponse
+	}{
+		Context:            annotationStateKey(annotation.Context),
+		Style:              annotation.Style,
+		AnnotationResponse: result,
+	}
+
+	return json.NewEncoder(out).Encode(output)
+}
+
+var (
+	disallowedContextRegex = regexp.MustCompile(`[^a-zA-Z0-9_.:/-]+`)
+	repeatedDashRegex      = regexp.MustCompile(`-+`)
+)
+
+// sanitizeAnnotationContext replaces runs of characters that aren't allowed in
+// a context with a dash, in the same way plugin identifiers are made
+func sanitizeAnnotationContext(context string) string {
+	sanitized := disallowedContextRegex.ReplaceAllString(context, "-")
+	sanitized = repeatedDashRegex.ReplaceAllString(sanitized, "-")
+	return strings.Trim(sanitized, "-")
+}
+
+// prefixAnnotationContext adds the prefix to the context, which is the
+// default context if it's empty
+func prefixAnnotationContext(prefix string, context string) string {
+	if prefix == "" {
+		return context
+	}
+	if context == "" {
+		context = "default"
+	}
+	return prefix + context
+}
+
+// annotationContextFromBody returns a short context derived from a hash of
+// the body, so the same body always maps to the same context
+func annotationContextFromBody(body string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(body)))[:16]
+}
+
+// annotationContextFromValues returns a short context that's a stable hash of
+// a comma separated list of values. Each value is trimmed and hashed with its
+// length so that empty values and values containing separators can't make
+// different lists hash the same.
+func annotationContextFromValues(values string) string {
+	h := sha256.New()
+	for _, value := range strings.Split(values, ",") {
+		value = strings.TrimSpace(value)
+		fmt.Fprintf(h, "%d:%s,", len(value), value)
+	}
+	return fmt.Sprintf("%x", h.Sum(nil))[:16]
+}
+
+// annotationInput is an annotation given as JSON with --input-json
+type annotationInput struct {
+	Body    string `json:"body"`
+	Style   string `json:"style"`
+	Context string `json:"context"`
+}
+
+// parseAnnotationInput parses an annotation given as a single JSON object,
+// where unknown fields are an error so that typos aren't silently ignored
+func parseAnnotationInput(data string) (annotationInput, error) {
+	var input annotationInput
+
+	if !strings.HasPrefix(strings.TrimSpace(data), "{") {
+		return input, fmt.Errorf("Failed to parse the annotation JSON: expected an object with body, style and context fields")
+	}
+
+	dec := json.NewDecoder(strings.NewReader(data))
+	dec.DisallowUnknownFields()
+
+	if err := dec.Decode(&input); err != nil {
+		return input, fmt.Errorf("Failed to parse the annotation JSON: %v", err)
+	}
+	if dec.More() {
+		return input, fmt.Errorf("Failed to parse the annotation JSON: expected a single object")
+	}
+
+	return input, nil
+}
+
+// annotationTransforms are the transforms that can clean up an annotation body
+var annotationTransforms = map[string]func(string) string{
+	"trim":            strings.TrimSpace,
+	"dedent":          dedentLines,
+	"collapse-blanks": collapseBlankLines,
+}
+
+// dedentLines removes the leading whitespace that every non-blank line has
+// in common. Tabs and spaces are treated as different characters.
+func dedentLines(s string) string {
+	lines := strings.Split(s, "\n")
+
+	var indent string
+	first := true
+	for _, line := range lines {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		lineIndent := line[:len(line)-len(strings.TrimLeft(line, " \t"))]
+		if first {
+			indent = lineIndent
+			first = false
+			continue
+		}
+
+		for !strings.HasPrefix(lineIndent, indent) {
+			indent = indent[:len(indent)-1]
+		}
+	}
+
+	for i, line := range lines {
+		if strings.TrimSpace(line) == "" {
+			lines[i] = strings.TrimLeft(line, " \t")
+		} else {
+			lines[i] = strings.TrimPrefix(line, indent)
+		}
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// collapseBlankLines replaces runs of blank lines, including lines that are
+// only whitespace, with a single empty line
+func collapseBlankLines(s string) string {
+	lines := strings.Split(s, "\n")
+	collapsed := make([]string, 0, len(lines))
+
+	for i, line := range lines {
+		if strings.TrimSpace(line) == "" {
+			if i > 0 && strings.TrimSpace(lines[i-1]) == "" {
+				continue
+			}
+			line = ""
+		}
+		collapsed = append(collapsed, line)
+	}
+
+	return strings.Join(collapsed, "\n")
+}
+
+// The characters that CommonMark allows to be escaped with a backslash
+const asciiPunctuation = "!\"#$%&'()*+,-./:;<=>?@[\\]^_`{|}~"
+
+// escapeAnnotationBody escapes the body so that it's shown as plain text. The
+// html mode only escapes HTML, and the markdown mode escapes every ASCII
+// punctuation character, which CommonMark shows as the literal character.
+func escapeAnnotationBody(mode string, body string) (string, error) {
+	switch mode {
+	case "html":
+		return html.EscapeString(body), nil
+	case "markdown":
+		var b strings.Builder
+		for _, r := range body {
+			if strings.ContainsRune(asciiPunctuation, r) {
+				b.WriteRune('\\')
+			}
+			b.WriteRune(r)
+		}
+		return b.String(), nil
+	default:
+		return "", fmt.Errorf("Unknown escape mode %q, expected html or markdown", mode)
+	}
+}
+
+// lastLines returns the last n lines of s, or all of s if it has fewer
+func lastLines(s string, n int) string {
+	lines := strings.SplitAfter(s, "\n")
+
+	// A trailing newline ends the last line rather than starting a new one
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+
+	if len(lines) <= n {
+		return s
+	}
+
+	return strings.Join(lines[len(lines)-n:], "")
+}
+
+// detailsBlock wraps the body in a collapsible <details> block with the
+// summary, which is escaped so that it's shown as plain text. The body is
+// surrounded by blank lines, without which Markdown inside the block isn't
+// rendered.
+func detailsBlock(summary string, body string) string {
+	return fmt.Sprintf("<details>\n<summary>%s</summary>\n\n%s\n\n</details>\n",
+		html.EscapeString(summary), strings.Trim(body, "\n"))
+}
+
+// alertBlock wraps the body in a GitHub style alert like > [!WARNING], which
+// is a quote with the type of alert on its first line
+func alertBlock(alert string, body string) (string, error) {
+	switch alert {
+	case "note", "tip", "important", "warning", "caution":
+	default:
+		return "", fmt.Errorf("Unknown --alert %q, expected note, tip, important, warning or caution", alert)
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "> [!%s]\n", strings.ToUpper(alert))
+	for _, line := range strings.Split(strings.Trim(body, "\n"), "\n") {
+		if line == "" {
+			b.WriteString(">\n")
+		} else {
+			fmt.Fprintf(&b, "> %s\n", line)
+		}
+	}
+
+	return b.String(), nil
+}
+
+// markdownTableFromTSV renders tab separated values as a Markdown table. The
+// first row is used as the headers, and every row is padded to the widest row
+// so the table is always rectangular.
+func markdownTableFromTSV(tsv string) string {
+	var rows [][]string
+	var columns int
+
+	for _, line := range strings.Split(strings.TrimRight(tsv, "\r\n"), "\n") {
+		row := strings.Split(strings.TrimSuffix(line, "\r"), "\t")
+		if len(row) > columns {
+			columns = len(row)
+		}
+		rows = append(rows, row)
+	}
+
+	var b strings.Builder
+	writeRow := func(row []string) {
+		b.WriteString("|")
+		for i := 0; i < columns; i++ {
+			var cell string
+			if i < len(row) {
+				cell = strings.ReplaceAll(strings.TrimSpace(row[i]), "|", "\\|")
+			}
+			b.WriteString(" " + cell + " |")
+		}
+		b.WriteString("\n")
+	}
+
+	writeRow(rows[0])
+	b.WriteString("|" + strings.Repeat(" --- |", columns) + "\n")
+	for _, row := range rows[1:] {
+		writeRow(row)
+	}
+
+	return b.String()
+}
+
+// readAllWithTimeout reads from r until EOF, giving up if that takes longer
+// than the timeout. A timeout of 0 waits forever.
+func readAllWithTimeout(r io.Reader, timeout time.Duration) ([]byte, error) {
+	if timeout == 0 {
+		return ioutil.ReadAll(r)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	type result struct {
+		b   []byte
+		err error
+	}
+
+	// The read can't be interrupted, so if it times out the goroutine is
+	// left blocked until the process exits
+	done := make(chan result, 1)
+	go func() {
+		b, err := ioutil.ReadAll(r)
+		done <- result{b, err}
+	}()
+
+	select {
+	case res := <-done:
+		return res.b, res.err
+	case <-ctx.Done():
+		return nil, fmt.Errorf("Timed out after %s waiting for input to finish", timeout)
+	}
+}
+
+// annotationStateDir returns the directory that annotation state is kept in,
+// which is a directory in the checkout path unless another one is given. It's
+// created if it's missing, so that only the agent's user can read it.
+func annotationStateDir(dir string, checkoutPath string) (string, error) {
+	if dir == "" {
+		if checkoutPath == "" {
+			return "", fmt.Errorf("There's no BUILDKITE_BUILD_CHECKOUT_PATH to keep it in, so one must be given with --state-dir")
+		}
+
+		// The default is in a predictable place, so make sure it's the
+		// directory we'd create rather than a link to somewhere else
+		dir = filepath.Join(checkoutPath, ".buildkite-annotate")
+		if info, err := os.Lstat(dir); err == nil && !info.IsDir() {
+			return "", fmt.Errorf("%s isn't a directory", dir)
+		}
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+
+	return dir, nil
+}
+
+// readAnnotationStateFile reads a state file, which is empty if it doesn't
+// exist. It won't follow a symlink, which could read another file.
+func readAnnotationStateFile(path string) ([]byte, error) {
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if !info.Mode().IsRegular() {
+		return nil, fmt.Errorf("%s isn't a regular file", path)
+	}
+
+	return ioutil.ReadFile(path)
+}
+
+// appendAnnotationStateFile appends a line to a state file, creating it if it
+// doesn't exist. It won't follow a symlink, which could write to another file.
+func appendAnnotationStateFile(path string, line string) error {
+	if info, err := os.Lstat(path); err == nil && !info.Mode().IsRegular() {
+		return fmt.Errorf("%s isn't a regular file", path)
+	}
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = fmt.Fprintln(f, line)
+	return err
+}
+
+// annotationStatePath returns the path of the file that records which
+// annotation contexts a job has already posted. It's named after the job, so
+// it's shared between every annotate call made by the same job.
+func annotationStatePath(dir string, job string) string {
+	return filepath.Join(dir, fmt.Sprintf("buildkite-annotate-%s", job))
+}
+
+// hasPostedAnnotationContext returns whether the state file lists the context.
+// A missing state file means nothing has been posted yet.
+func hasPostedAnnotationContext(path string, context string) (bool, error) {
+	b, err := readAnnotationStateFile(path)
+	if err != nil {
+		return false, err
+	}
+
+	for _, line := range strings.Split(string(b), "\n") {
+		if line == annotationStateKey(context) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// recordPostedAnnotationContext appends the context to the state file
+func recordPostedAnnotationContext(path string, context string) error {
+	return appendAnnotationStateFile(path, annotationStateKey(context))
+}
+
+// annotationHashStatePath returns the path of the file that records a hash of
+// the last annotation a job posted to each context
+func annotationHashStatePath(dir string, job string) string {
+	return annotationStatePath(dir, job) + "-hashes"
+}
+
+// annotationHash returns a hash of everything that an annotation shows
+func annotationHash(style string, body string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(style+"\n"+body)))
+}
+
+// lastAnnotationHash returns the hash of the last annotation posted to the
+// context, or an empty string if there isn't one
+func lastAnnotationHash(path string, context string) (string, error) {
+	b, err := readAnnotationStateFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	var hash string
+	for _, line := range strings.Split(string(b), "\n") {
+		parts := strings.SplitN(line, " ", 2)
+		if len(parts) == 2 && parts[0] == annotationStateFileKey(context) {
+			hash = parts[1]
+		}
+	}
+
+	return hash, nil
+}
+
+// recordAnnotationHash appends the hash of the annotation posted to the
+// context to the state file, where later entries take precedence
+func recordAnnotationHash(path string, context string, hash string) error {
+	return appendAnnotationStateFile(path, annotationStateFileKey(context)+" "+hash)
+}
+
+// annotationAppendStatePath returns the path of the file that records how many
+// bytes a job has appended to each context
+func annotationAppendStatePath(dir string, job string) string {
+	return annotationStatePath(dir, job) + "-appended"
+}
+
+// appendedAnnotationSize returns the total number of bytes that have been
+// appended to the context, which is 0 if nothing has been
+func appendedAnnotationSize(path string, context string) (int, error) {
+	b, err := readAnnotationStateFile(path)
+	if err != nil {
+		return 0, err
+	}
+
+	var total int
+	for _, line := range strings.Split(string(b), "\n") {
+		parts := strings.SplitN(line, " ", 2)
+		if len(parts) == 2 && parts[0] == annotationStateFileKey(context) {
+			size, err := strconv.Atoi(parts[1])
+			if err != nil {
+				return 0, fmt.Errorf("Invalid appended size %q", parts[1])
+			}
+			total += size
+		}
+	}
+
+	return total, nil
+}
+
+// recordAppendedAnnotationSize appends the size of an append to the context
+// to the state file, where the sizes are added up
+func recordAppendedAnnotationSize(path string, context string, size int) error {
+	return appendAnnotationStateFile(path, fmt.Sprintf("%s %d", annotationStateFileKey(context), size))
+}
+
+// annotationPrefixStatePath returns the path of the file that records which
+// annotation contexts a job has added the --prefix to
+func annotationPrefixStatePath(dir string, job string) string {
+	return annotationStatePath(dir, job) + "-prefixed"
+}
+
+// An empty context is the default context, so they share a state entry
+func annotationStateKey(context string) string {
+	if context == "" {
+		return "default"
+	}
+	return context
+}
+
+// annotationStateFileKey is the state key of a context escaped so that it
+// doesn't contain spaces or newlines, and so can start a line in a state file
+// that's followed by a space and a value
+func annotationStateFileKey(context string) string {
+	return url.QueryEscape(annotationStateKey(context))
 }
@@ -0,0 +1,1413 @@
+package clicommand
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAnnotateOncePerStepSkipsSecondCall(t *testing.T) {
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		requests++
+		rw.WriteHeader(http.StatusCreated)
+		fmt.Fprint(rw, `{}`)
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "annotate-once-per-step")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := AnnotateConfig{
+		Body:             "All tests passed",
+		Context:          "junit",
+		OncePerStep:      true,
+		StateDir:         dir,
+		Job:              "once-per-step-test-job",
+		AgentAccessToken: "llamas",
+		Endpoint:         server.URL,
+	}
+
+	l := logger.NewBuffer()
+
+	assert.NoError(t, annotate(cfg, l, ioutil.Discard))
+	assert.Equal(t, 1, requests)
+
+	assert.NoError(t, annotate(cfg, l, ioutil.Discard))
+	assert.Equal(t, 1, requests)
+	assert.Contains(t, l.Messages, "[info] An annotation with this context has already been posted by this job, skipping")
+
+	// A different context from the same job is still posted
+	cfg.Context = "coverage"
+	assert.NoError(t, annotate(cfg, l, ioutil.Discard))
+	assert.Equal(t, 2, requests)
+}
+
+func TestAnnotateStateDir(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusCreated)
+		fmt.Fprint(rw, `{}`)
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "annotate-state-dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	stateDir := filepath.Join(dir, "annotate", "state")
+
+	cfg := AnnotateConfig{
+		Body:             "All tests passed",
+		Context:          "junit",
+		OncePerStep:      true,
+		IfChanged:        true,
+		StateDir:         stateDir,
+		Job:              "state-dir-test-job",
+		AgentAccessToken: "llamas",
+		Endpoint:         server.URL,
+	}
+
+	assert.NoError(t, annotate(cfg, logger.NewBuffer(), ioutil.Discard))
+
+	info, err := os.Stat(stateDir)
+	if assert.NoError(t, err) && runtime.GOOS != "windows" {
+		assert.Equal(t, os.FileMode(0700), info.Mode().Perm())
+	}
+
+	assert.FileExists(t, annotationStatePath(stateDir, cfg.Job))
+	assert.FileExists(t, annotationHashStatePath(stateDir, cfg.Job))
+
+	// Without a state directory it's kept in the checkout path
+	checkoutPath := filepath.Join(dir, "checkout")
+	if err := os.Mkdir(checkoutPath, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg.StateDir = ""
+	cfg.CheckoutPath = checkoutPath
+	assert.NoError(t, annotate(cfg, logger.NewBuffer(), ioutil.Discard))
+
+	defaultStateDir := filepath.Join(checkoutPath, ".buildkite-annotate")
+	info, err = os.Stat(defaultStateDir)
+	if assert.NoError(t, err) && runtime.GOOS != "windows" {
+		assert.Equal(t, os.FileMode(0700), info.Mode().Perm())
+	}
+
+	assert.FileExists(t, annotationStatePath(defaultStateDir, cfg.Job))
+
+	// Which has to be given when there's no checkout path
+	cfg.CheckoutPath = ""
+	assert.EqualError(t, annotate(cfg, logger.NewBuffer(), ioutil.Discard),
+		"Failed to create the annotation state directory: There's no BUILDKITE_BUILD_CHECKOUT_PATH to keep it in, so one must be given with --state-dir")
+}
+
+func TestAnnotateStateDoesntFollowSymlinks(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Creating symlinks needs extra privileges")
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusCreated)
+		fmt.Fprint(rw, `{}`)
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "annotate-symlinks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	target := filepath.Join(dir, "target")
+	if err := ioutil.WriteFile(target, []byte("secrets\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	stateDir := filepath.Join(dir, "state")
+	if err := os.Mkdir(stateDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := AnnotateConfig{
+		Body:             "All tests passed",
+		Context:          "junit",
+		OncePerStep:      true,
+		StateDir:         stateDir,
+		Job:              "symlink-test-job",
+		AgentAccessToken: "llamas",
+		Endpoint:         server.URL,
+	}
+
+	statePath := annotationStatePath(stateDir, cfg.Job)
+	if err := os.Symlink(target, statePath); err != nil {
+		t.Fatal(err)
+	}
+
+	err = annotate(cfg, logger.NewBuffer(), ioutil.Discard)
+	assert.EqualError(t, err, fmt.Sprintf("Failed to read annotation state from %s: %s isn't a regular file", statePath, statePath))
+
+	// Nor is the default state directory used if it's a symlink
+	checkoutPath := filepath.Join(dir, "checkout")
+	if err := os.Mkdir(checkoutPath, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(stateDir, filepath.Join(checkoutPath, ".buildkite-annotate")); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg.StateDir = ""
+	cfg.CheckoutPath = checkoutPath
+	assert.Error(t, annotate(cfg, logger.NewBuffer(), ioutil.Discard))
+
+	b, err := ioutil.ReadFile(target)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "secrets\n", string(b))
+	}
+}
+
+func TestAnnotateMaxAppendSize(t *testing.T) {
+	var bodies []string
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		var annotation api.Annotation
+		json.NewDecoder(req.Body).Decode(&annotation)
+		bodies = append(bodies, annotation.Body)
+		rw.WriteHeader(http.StatusCreated)
+		fmt.Fprint(rw, `{}`)
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "annotate-max-append-size")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := AnnotateConfig{
+		Body:             "line\n",
+		Context:          "progress",
+		Append:           true,
+		MaxAppendSize:    10,
+		StateDir:         dir,
+		Job:              "max-append-size-test-job",
+		AgentAccessToken: "llamas",
+		Endpoint:         server.URL,
+	}
+
+	l := logger.NewBuffer()
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, annotate(cfg, l, ioutil.Discard))
+	}
+	assert.Equal(t, []string{"line\n", "line\n"}, bodies)
+	assert.Contains(t, l.Messages, "[info] Appending 5 bytes would take this job past the --max-append-size of 10 bytes, as it's already appended 10 bytes to this annotation, skipping")
+
+	// Other contexts have their own limit
+	cfg.Context = "other"
+	assert.NoError(t, annotate(cfg, l, ioutil.Discard))
+	assert.Len(t, bodies, 3)
+
+	// Including contexts with spaces, and the contexts they start with
+	cfg.Context = "build logs"
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, annotate(cfg, l, ioutil.Discard))
+	}
+	assert.Len(t, bodies, 5)
+
+	cfg.Context = "build"
+	assert.NoError(t, annotate(cfg, l, ioutil.Discard))
+	assert.Len(t, bodies, 6)
+
+	// A prefix counts towards the limit
+	cfg.Context = "prefixed"
+	cfg.Prefix = "## Log"
+	assert.NoError(t, annotate(cfg, l, ioutil.Discard))
+	assert.Len(t, bodies, 6)
+	assert.Contains(t, l.Messages, "[info] Appending 13 bytes would take this job past the --max-append-size of 10 bytes, as it's already appended 0 bytes to this annotation, skipping")
+
+	cfg.MaxAppendSize = 20
+	assert.NoError(t, annotate(cfg, l, ioutil.Discard))
+	assert.NoError(t, annotate(cfg, l, ioutil.Discard))
+	assert.Equal(t, []string{"## Log\n\nline\n", "line\n"}, bodies[6:])
+	assert.NoError(t, annotate(cfg, l, ioutil.Discard))
+	assert.Len(t, bodies, 8)
+
+	err = annotate(AnnotateConfig{Body: "llamas", MaxAppendSize: 10, Job: "job"}, l, ioutil.Discard)
+	assert.EqualError(t, err, "--max-append-size requires --append or --append-to-context")
+
+	err = annotate(AnnotateConfig{Body: "llamas", Append: true, MaxAppendSize: -1, Job: "job"}, l, ioutil.Discard)
+	assert.EqualError(t, err, "--max-append-size must be a positive number of bytes")
+}
+
+func TestReadAllWithTimeout(t *testing.T) {
+	b, err := readAllWithTimeout(strings.NewReader("llamas"), 0)
+	assert.NoError(t, err)
+	assert.Equal(t, "llamas", string(b))
+
+	b, err = readAllWithTimeout(strings.NewReader("alpacas"), time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, "alpacas", string(b))
+
+	// A pipe that is never closed behaves like a hung generator
+	r, w := io.Pipe()
+	defer w.Close()
+	go w.Write([]byte("partial output"))
+
+	_, err = readAllWithTimeout(r, 50*time.Millisecond)
+	assert.EqualError(t, err, "Timed out after 50ms waiting for input to finish")
+}
+
+func TestAnnotationContextFromBody(t *testing.T) {
+	assert.Equal(t, annotationContextFromBody("All tests passed"), annotationContextFromBody("All tests passed"))
+	assert.NotEqual(t, annotationContextFromBody("All tests passed"), annotationContextFromBody("2 tests failed"))
+	assert.Len(t, annotationContextFromBody("All tests passed"), 16)
+}
+
+func TestAnnotationContextFromValues(t *testing.T) {
+	assert.Equal(t, annotationContextFromValues("linux,amd64,3.1"), annotationContextFromValues("linux,amd64,3.1"))
+	assert.Equal(t, annotationContextFromValues("linux,amd64,3.1"), annotationContextFromValues(" linux, amd64 ,3.1 "))
+	assert.Len(t, annotationContextFromValues("linux,amd64,3.1"), 16)
+
+	// Every component counts, including empty ones and their position
+	contexts := map[string]string{}
+	for _, values := range []string{"linux,amd64,3.1", "linux,arm64,3.1", "linux,,3.1", "linux,3.1", ",linux,3.1", "linux,3.1,", ",", "linux"} {
+		context := annotationContextFromValues(values)
+		if other, ok := contexts[context]; ok {
+			t.Errorf("%q and %q have the same context %q", values, other, context)
+		}
+		contexts[context] = values
+	}
+}
+
+func TestAnnotateContextFromConflicts(t *testing.T) {
+	l := logger.NewBuffer()
+
+	err := annotate(AnnotateConfig{Body: "llamas", ContextFrom: "linux,amd64", Context: "junit", Job: "job"}, l, ioutil.Discard)
+	assert.EqualError(t, err, "--context-from can't be used with --context")
+
+	err = annotate(AnnotateConfig{Body: "llamas", ContextFrom: "linux,amd64", ContextHash: true, Job: "job"}, l, ioutil.Discard)
+	assert.EqualError(t, err, "--context-from can't be used with --context-hash")
+
+	err = annotate(AnnotateConfig{Body: "llamas", ContextFrom: "linux,amd64", AppendTo: "junit", Job: "job"}, l, ioutil.Discard)
+	assert.EqualError(t, err, "--append-to-context can't be used with --context-from")
+}
+
+func TestAnnotateContextHashConflicts(t *testing.T) {
+	l := logger.NewBuffer()
+
+	err := annotate(AnnotateConfig{Body: "llamas", ContextHash: true, Append: true, Job: "job"}, l, ioutil.Discard)
+	assert.EqualError(t, err, "--context-hash can't be used with --append")
+
+	err = annotate(AnnotateConfig{Body: "llamas", ContextHash: true, Context: "junit", Job: "job"}, l, ioutil.Discard)
+	assert.EqualError(t, err, "--context-hash can't be used with --context")
+}
+
+func TestAnnotateReplaceConflictsWithAppend(t *testing.T) {
+	l := logger.NewBuffer()
+
+	err := annotate(AnnotateConfig{Body: "llamas", Replace: true, Append: true, Job: "job"}, l, ioutil.Discard)
+	assert.EqualError(t, err, "--replace can't be used with --append")
+}
+
+func TestPrefixAnnotationContext(t *testing.T) {
+	assert.Equal(t, "junit", prefixAnnotationContext("", "junit"))
+	assert.Equal(t, "", prefixAnnotationContext("", ""))
+	assert.Equal(t, "team-a/junit", prefixAnnotationContext("team-a/", "junit"))
+	assert.Equal(t, "team-a/default", prefixAnnotationContext("team-a/", ""))
+	assert.Equal(t, "team-a/"+annotationContextFromBody("llamas"), prefixAnnotationContext("team-a/", annotationContextFromBody("llamas")))
+}
+
+func TestAnnotateSendsPrefixedContext(t *testing.T) {
+	var contexts []string
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		var annotation api.Annotation
+		json.NewDecoder(req.Body).Decode(&annotation)
+		contexts = append(contexts, annotation.Context)
+		rw.WriteHeader(http.StatusCreated)
+		fmt.Fprint(rw, `{}`)
+	}))
+	defer server.Close()
+
+	cfg := AnnotateConfig{
+		Body:             "All tests passed",
+		ContextPrefix:    "team-a/",
+		Job:              "job",
+		AgentAccessToken: "llamas",
+		Endpoint:         server.URL,
+	}
+
+	assert.NoError(t, annotate(cfg, logger.NewBuffer(), ioutil.Discard))
+
+	cfg.Context = "junit"
+	assert.NoError(t, annotate(cfg, logger.NewBuffer(), ioutil.Discard))
+
+	assert.Equal(t, []string{"team-a/default", "team-a/junit"}, contexts)
+}
+
+func TestAnnotateNoStdinIgnoresStdin(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	fmt.Fprint(w, "From STDIN")
+	w.Close()
+
+	oldStdin := os.Stdin
+	os.Stdin = r
+	defer func() { os.Stdin = oldStdin }()
+
+	err = annotate(AnnotateConfig{NoStdin: true, Job: "job"}, logger.NewBuffer(), ioutil.Discard)
+	assert.EqualError(t, err, "--no-stdin requires an annotation body argument or --file")
+
+	var bodies []string
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		var annotation api.Annotation
+		json.NewDecoder(req.Body).Decode(&annotation)
+		bodies = append(bodies, annotation.Body)
+		rw.WriteHeader(http.StatusCreated)
+		fmt.Fprint(rw, `{}`)
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "annotate-no-stdin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "body.md")
+	if err := ioutil.WriteFile(file, []byte("From a file"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := AnnotateConfig{
+		File:             file,
+		NoStdin:          true,
+		Job:              "job",
+		AgentAccessToken: "llamas",
+		Endpoint:         server.URL,
+	}
+	assert.NoError(t, annotate(cfg, logger.NewBuffer(), ioutil.Discard))
+	assert.Equal(t, []string{"From a file"}, bodies)
+
+	// STDIN is still there to be read
+	b, err := ioutil.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Equal(t, "From STDIN", string(b))
+}
+
+func TestDetailsBlock(t *testing.T) {
+	assert.Equal(t, ""+
+		"<details>\n"+
+		"<summary>3 tests failed</summary>\n"+
+		"\n"+
+		"* login\n"+
+		"* search\n"+
+		"\n"+
+		"</details>\n",
+		detailsBlock("3 tests failed", "\n* login\n* search\n\n"))
+
+	// The summary is plain text
+	assert.Equal(t, "<details>\n<summary>&lt;b&gt;Logs&lt;/b&gt; &amp; more</summary>\n\nllamas\n\n</details>\n", detailsBlock("<b>Logs</b> & more", "llamas"))
+}
+
+func TestAnnotateDetailsSummary(t *testing.T) {
+	var bodies []string
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		var annotation api.Annotation
+		json.NewDecoder(req.Body).Decode(&annotation)
+		bodies = append(bodies, annotation.Body)
+		rw.WriteHeader(http.StatusCreated)
+		fmt.Fprint(rw, `{}`)
+	}))
+	defer server.Close()
+
+	cfg := AnnotateConfig{
+		Body:             "Test\tResult\nlogin\tfailed\n",
+		Table:            true,
+		Details:          "1 test failed",
+		Job:              "job",
+		AgentAccessToken: "llamas",
+		Endpoint:         server.URL,
+	}
+	assert.NoError(t, annotate(cfg, logger.NewBuffer(), ioutil.Discard))
+	assert.Equal(t, []string{"<details>\n<summary>1 test failed</summary>\n\n| Test | Result |\n| --- | --- |\n| login | failed |\n\n</details>\n"}, bodies)
+
+	dir, err := ioutil.TempDir("", "annotate-details-summary")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	empty := filepath.Join(dir, "empty.md")
+	if err := ioutil.WriteFile(empty, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	err = annotate(AnnotateConfig{File: empty, Details: "Nothing", Job: "job"}, logger.NewBuffer(), ioutil.Discard)
+	assert.EqualError(t, err, "--details-summary requires an annotation body")
+}
+
+func TestAlertBlock(t *testing.T) {
+	for alert, header := range map[string]string{
+		"note":      "> [!NOTE]\n",
+		"tip":       "> [!TIP]\n",
+		"important": "> [!IMPORTANT]\n",
+		"warning":   "> [!WARNING]\n",
+		"caution":   "> [!CAUTION]\n",
+	} {
+		block, err := alertBlock(alert, "Deploys are frozen\n\nAsk in #releases\n")
+		if assert.NoError(t, err, alert) {
+			assert.Equal(t, header+"> Deploys are frozen\n>\n> Ask in #releases\n", block, alert)
+		}
+	}
+
+	_, err := alertBlock("danger", "llamas")
+	assert.EqualError(t, err, `Unknown --alert "danger", expected note, tip, important, warning or caution`)
+}
+
+func TestAnnotateAlertWithStyle(t *testing.T) {
+	var annotations []api.Annotation
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		var annotation api.Annotation
+		json.NewDecoder(req.Body).Decode(&annotation)
+		annotations = append(annotations, annotation)
+		rw.WriteHeader(http.StatusCreated)
+		fmt.Fprint(rw, `{}`)
+	}))
+	defer server.Close()
+
+	cfg := AnnotateConfig{
+		Body:             "Tests are flaky",
+		Alert:            "warning",
+		Style:            "warning",
+		Job:              "job",
+		AgentAccessToken: "llamas",
+		Endpoint:         server.URL,
+	}
+	assert.NoError(t, annotate(cfg, logger.NewBuffer(), ioutil.Discard))
+
+	if assert.Len(t, annotations, 1) {
+		assert.Equal(t, "> [!WARNING]\n> Tests are flaky\n", annotations[0].Body)
+		assert.Equal(t, "warning", annotations[0].Style)
+	}
+}
+
+func TestMarkdownTableFromTSV(t *testing.T) {
+	tsv := "Test\tResult\tNotes\r\n" +
+		"login\tpassed\t\n" +
+		"search\tfailed\ta|b\n" +
+		"logout\tskipped\n"
+
+	assert.Equal(t, ""+
+		"| Test | Result | Notes |\n"+
+		"| --- | --- | --- |\n"+
+		"| login | passed |  |\n"+
+		"| search | failed | a\\|b |\n"+
+		"| logout | skipped |  |\n",
+		markdownTableFromTSV(tsv))
+}
+
+func TestAnnotateRetriesAfterRateLimit(t *testing.T) {
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		requests++
+		if requests == 1 {
+			rw.Header().Set("Retry-After", "0")
+			http.Error(rw, `{"message":"Slow down"}`, http.StatusTooManyRequests)
+			return
+		}
+		rw.WriteHeader(http.StatusCreated)
+		fmt.Fprint(rw, `{}`)
+	}))
+	defer server.Close()
+
+	cfg := AnnotateConfig{
+		Body:             "More tests passed",
+		Append:           true,
+		Job:              "job",
+		AgentAccessToken: "llamas",
+		Endpoint:         server.URL,
+	}
+
+	start := time.Now()
+	assert.NoError(t, annotate(cfg, logger.NewBuffer(), ioutil.Discard))
+	assert.Equal(t, 2, requests)
+
+	// Retry-After takes precedence over the one second retry interval
+	assert.True(t, time.Since(start) < time.Second, "Expected the retry to honor Retry-After")
+}
+
+func TestLastLines(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		input    string
+		expected string
+	}{
+		{"fewer lines", "one\ntwo\n", "one\ntwo\n"},
+		{"exactly n lines", "one\ntwo\nthree\n", "one\ntwo\nthree\n"},
+		{"more lines", "one\ntwo\nthree\nfour\nfive\n", "three\nfour\nfive\n"},
+		{"no trailing newline", "one\ntwo\nthree\nfour", "two\nthree\nfour"},
+		{"empty", "", ""},
+	} {
+		assert.Equal(t, tc.expected, lastLines(tc.input, 3), tc.name)
+	}
+}
+
+func TestAnnotationStyleFromFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "annotate-style")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "exit-status")
+
+	for contents, expected := range map[string]string{
+		"0\n":       "success",
+		"1":         "error",
+		" 137 \n":   "error",
+		"-1":        "error",
+		"warning\n": "warning",
+		"  info  ":  "info",
+		"success":   "success",
+		"error\r\n": "error",
+	} {
+		if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		style, err := annotationStyleFromFile(path)
+		if assert.NoError(t, err, contents) {
+			assert.Equal(t, expected, style, contents)
+		}
+	}
+
+	for _, contents := range []string{"", "llamas", "1.5", "Warning"} {
+		if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		_, err := annotationStyleFromFile(path)
+		assert.EqualError(t, err, fmt.Sprintf("Failed to read annotation style from %s: expected an exit code or one of success, info, warning, error, got %q", path, contents))
+	}
+
+	_, err = annotationStyleFromFile(filepath.Join(dir, "missing"))
+	assert.Contains(t, fmt.Sprint(err), "Failed to read annotation style from ")
+
+	err = annotate(AnnotateConfig{Body: "llamas", Style: "info", StyleFile: path, Job: "job"}, logger.NewBuffer(), ioutil.Discard)
+	assert.EqualError(t, err, "--style-from-file can't be used with --style")
+}
+
+func TestAnnotateTailRequiresFile(t *testing.T) {
+	l := logger.NewBuffer()
+
+	err := annotate(AnnotateConfig{Body: "llamas", Tail: 10, Job: "job"}, l, ioutil.Discard)
+	assert.EqualError(t, err, "--tail requires --file")
+
+	f, err := ioutil.TempFile("", "annotate-tail")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.Close()
+
+	err = annotate(AnnotateConfig{Body: "llamas", File: f.Name(), Job: "job"}, l, ioutil.Discard)
+	assert.EqualError(t, err, "--file can't be used with an annotation body argument")
+}
+
+func TestNewAnnotationWithoutBody(t *testing.T) {
+	annotation := newAnnotation(AnnotateConfig{Style: "success", Context: "junit"}, "")
+
+	b, err := json.Marshal(annotation)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.JSONEq(t, `{"context":"junit","style":"success"}`, string(b))
+}
+
+func TestAnnotatePrintsResult(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusCreated)
+		fmt.Fprint(rw, `{"id":"0191e3f0-1234","url":"https://buildkite.com/org/pipeline/builds/1#annotation-junit"}`)
+	}))
+	defer server.Close()
+
+	cfg := AnnotateConfig{
+		Body:             "All tests passed",
+		Style:            "success",
+		Context:          "junit",
+		Job:              "job",
+		AgentAccessToken: "llamas",
+		Endpoint:         server.URL,
+	}
+
+	// Nothing is printed without the flag
+	var out strings.Builder
+	assert.NoError(t, annotate(cfg, logger.NewBuffer(), &out))
+	assert.Equal(t, "", out.String())
+
+	cfg.PrintResult = true
+	assert.NoError(t, annotate(cfg, logger.NewBuffer(), &out))
+	assert.JSONEq(t, `{
+		"context": "junit",
+		"style": "success",
+		"id": "0191e3f0-1234",
+		"url": "https://buildkite.com/org/pipeline/builds/1#annotation-junit"
+	}`, out.String())
+}
+
+func TestAnnotateStopsRetryingAtDeadline(t *testing.T) {
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		requests++
+		http.Error(rw, `{"message":"Oh no"}`, http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	cfg := AnnotateConfig{
+		Body:             "All tests passed",
+		Deadline:         "500ms",
+		Job:              "job",
+		AgentAccessToken: "llamas",
+		Endpoint:         server.URL,
+	}
+
+	start := time.Now()
+	err := annotate(cfg, logger.NewBuffer(), ioutil.Discard)
+
+	// The retry interval is a second, so there's no time for a second attempt
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "giving up as the next attempt would be past the deadline")
+	}
+	assert.Equal(t, 1, requests)
+	assert.True(t, time.Since(start) < time.Second, "Expected annotate to give up before the deadline")
+}
+
+func TestAnnotateCancelsRequestsAtDeadline(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		// The request is only seen to be cancelled once its body is read
+		ioutil.ReadAll(req.Body)
+		select {
+		case <-req.Context().Done():
+		case <-time.After(10 * time.Second):
+		}
+		rw.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	cfg := AnnotateConfig{
+		Body:             "All tests passed",
+		Deadline:         "500ms",
+		Job:              "job",
+		AgentAccessToken: "llamas",
+		Endpoint:         server.URL,
+	}
+
+	start := time.Now()
+	err := annotate(cfg, logger.NewBuffer(), ioutil.Discard)
+
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "context deadline exceeded")
+	}
+	assert.True(t, time.Since(start) < 5*time.Second, "Expected the request to be cancelled at the deadline")
+}
+
+func TestEscapeAnnotationBody(t *testing.T) {
+	body := "<script>alert('hi')</script> **bold** [link](http://example.com) & `code`"
+
+	escaped, err := escapeAnnotationBody("html", body)
+	assert.NoError(t, err)
+	assert.Equal(t, "&lt;script&gt;alert(&#39;hi&#39;)&lt;/script&gt; **bold** [link](http://example.com) &amp; `code`", escaped)
+
+	escaped, err = escapeAnnotationBody("markdown", body)
+	assert.NoError(t, err)
+	assert.Equal(t, "\\<script\\>alert\\(\\'hi\\'\\)\\<\\/script\\> \\*\\*bold\\*\\* \\[link\\]\\(http\\:\\/\\/example\\.com\\) \\& \\`code\\`", escaped)
+
+	_, err = escapeAnnotationBody("rot13", body)
+	assert.EqualError(t, err, `Unknown escape mode "rot13", expected html or markdown`)
+}
+
+func TestAnnotateIfChanged(t *testing.T) {
+	var bodies []string
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		var annotation api.Annotation
+		json.NewDecoder(req.Body).Decode(&annotation)
+		bodies = append(bodies, annotation.Body)
+		rw.WriteHeader(http.StatusCreated)
+		fmt.Fprint(rw, `{}`)
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "annotate-if-changed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := AnnotateConfig{
+		Body:             "3 tests failed",
+		Context:          "junit",
+		IfChanged:        true,
+		StateDir:         dir,
+		Job:              "if-changed-test-job",
+		AgentAccessToken: "llamas",
+		Endpoint:         server.URL,
+	}
+
+	l := logger.NewBuffer()
+
+	// Without a state file it's always posted
+	assert.NoError(t, annotate(cfg, l, ioutil.Discard))
+
+	// Unchanged content is skipped
+	assert.NoError(t, annotate(cfg, l, ioutil.Discard))
+	assert.Contains(t, l.Messages, "[info] The annotation hasn't changed since it was last posted by this job, skipping")
+
+	// Changed content is posted, and then skipped when it's unchanged again
+	cfg.Body = "2 tests failed"
+	assert.NoError(t, annotate(cfg, l, ioutil.Discard))
+	assert.NoError(t, annotate(cfg, l, ioutil.Discard))
+
+	// Going back to earlier content is a change too
+	cfg.Body = "3 tests failed"
+	assert.NoError(t, annotate(cfg, l, ioutil.Discard))
+
+	// A changed style is posted
+	cfg.Style = "error"
+	assert.NoError(t, annotate(cfg, l, ioutil.Discard))
+
+	assert.Equal(t, []string{"3 tests failed", "2 tests failed", "3 tests failed", "3 tests failed"}, bodies)
+
+	// Contexts with spaces are kept apart from contexts they start with
+	cfg.Context = "junit tests"
+	assert.NoError(t, annotate(cfg, l, ioutil.Discard))
+	assert.NoError(t, annotate(cfg, l, ioutil.Discard))
+	cfg.Context = "junit"
+	assert.NoError(t, annotate(cfg, l, ioutil.Discard))
+
+	assert.Equal(t, []string{"3 tests failed", "2 tests failed", "3 tests failed", "3 tests failed", "3 tests failed"}, bodies)
+
+	cfg.Append = true
+	assert.EqualError(t, annotate(cfg, l, ioutil.Discard), "--if-changed can't be used with --append")
+}
+
+func TestAnnotateDoesntRetryFailedAppends(t *testing.T) {
+	var appends, replaces int
+	rateLimited := false
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		var annotation api.Annotation
+		json.NewDecoder(req.Body).Decode(&annotation)
+		if annotation.Append {
+			appends++
+			if rateLimited {
+				rateLimited = false
+				rw.Header().Set("Retry-After", "0")
+				http.Error(rw, `{"message":"Too Many Requests"}`, http.StatusTooManyRequests)
+				return
+			}
+			if appends > 2 {
+				rw.WriteHeader(http.StatusCreated)
+				fmt.Fprint(rw, `{}`)
+				return
+			}
+		} else {
+			replaces++
+			if replaces > 1 {
+				rw.WriteHeader(http.StatusCreated)
+				fmt.Fprint(rw, `{}`)
+				return
+			}
+		}
+		http.Error(rw, `{"message":"Internal Server Error"}`, http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	cfg := AnnotateConfig{
+		Body:             "line",
+		Context:          "progress",
+		Append:           true,
+		Job:              "job",
+		AgentAccessToken: "llamas",
+		Endpoint:         server.URL,
+	}
+
+	// The append may have been applied, so it isn't tried again
+	assert.Error(t, annotate(cfg, logger.NewBuffer(), ioutil.Discard))
+	assert.Equal(t, 1, appends)
+
+	// A rate limited append wasn't applied, so it's retried
+	rateLimited = true
+	assert.NoError(t, annotate(cfg, logger.NewBuffer(), ioutil.Discard))
+	assert.Equal(t, 3, appends)
+
+	// Replacing is retried
+	cfg.Append = false
+	assert.NoError(t, annotate(cfg, logger.NewBuffer(), ioutil.Discard))
+	assert.Equal(t, 2, replaces)
+}
+
+func TestAnnotateAppendToContext(t *testing.T) {
+	existing := map[string]bool{"tests": true}
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		var annotation api.Annotation
+		json.NewDecoder(req.Body).Decode(&annotation)
+		if annotation.RequireExisting && !existing[annotation.Context] {
+			http.Error(rw, `{"message":"Not Found"}`, http.StatusNotFound)
+			return
+		}
+		if !annotation.Append {
+			t.Errorf("Expected an append to %q", annotation.Context)
+		}
+		rw.WriteHeader(http.StatusCreated)
+		fmt.Fprint(rw, `{}`)
+	}))
+	defer server.Close()
+
+	cfg := AnnotateConfig{
+		Body:             "Coverage is 87%",
+		AppendTo:         "tests",
+		Job:              "job",
+		AgentAccessToken: "llamas",
+		Endpoint:         server.URL,
+	}
+
+	assert.NoError(t, annotate(cfg, logger.NewBuffer(), ioutil.Discard))
+
+	cfg.AppendTo = "coverage"
+	err := annotate(cfg, logger.NewBuffer(), ioutil.Discard)
+	assert.EqualError(t, err, `Failed to annotate build: there's no annotation with the context "coverage" to append to`)
+
+	cfg.Context = "junit"
+	err = annotate(cfg, logger.NewBuffer(), ioutil.Discard)
+	assert.EqualError(t, err, "--append-to-context can't be used with --context")
+}
+
+func TestAnnotateCheckJobState(t *testing.T) {
+	state := "finished"
+	var annotations int
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		switch req.Method + " " + req.URL.Path {
+		case "GET /jobs/job":
+			fmt.Fprintf(rw, `{"state":%q}`, state)
+		case "POST /jobs/job/annotations":
+			annotations++
+			rw.WriteHeader(http.StatusCreated)
+			fmt.Fprint(rw, `{}`)
+		default:
+			t.Errorf("Unexpected request %s %s", req.Method, req.URL.Path)
+			http.Error(rw, "Not found", http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	cfg := AnnotateConfig{
+		Body:             "All tests passed",
+		CheckJobState:    "skip",
+		Job:              "job",
+		AgentAccessToken: "llamas",
+		Endpoint:         server.URL,
+	}
+
+	l := logger.NewBuffer()
+	assert.NoError(t, annotate(cfg, l, ioutil.Discard))
+	assert.Contains(t, l.Messages, "[info] The job is finished, skipping the annotation")
+	assert.Equal(t, 0, annotations)
+
+	cfg.CheckJobState = "fail"
+	assert.EqualError(t, annotate(cfg, logger.NewBuffer(), ioutil.Discard), "The job is finished, so it can't be annotated")
+	assert.Equal(t, 0, annotations)
+
+	state = "running"
+	assert.NoError(t, annotate(cfg, logger.NewBuffer(), ioutil.Discard))
+	assert.Equal(t, 1, annotations)
+
+	cfg.CheckJobState = "llamas"
+	assert.EqualError(t, annotate(cfg, logger.NewBuffer(), ioutil.Discard), `Unknown --check-job-state "llamas", expected skip or fail`)
+}
+
+func TestAnnotatePrefix(t *testing.T) {
+	bodies := map[string]string{}
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		var annotation api.Annotation
+		json.NewDecoder(req.Body).Decode(&annotation)
+		if annotation.Append {
+			bodies[annotation.Context] += annotation.Body
+		} else {
+			bodies[annotation.Context] = annotation.Body
+		}
+		rw.WriteHeader(http.StatusCreated)
+		fmt.Fprint(rw, `{}`)
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "annotate-prefix")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := AnnotateConfig{
+		Body:             "All tests passed",
+		Context:          "tests",
+		Prefix:           "**Team Llama**",
+		StateDir:         dir,
+		Job:              "job",
+		AgentAccessToken: "llamas",
+		Endpoint:         server.URL,
+	}
+
+	// Creating or replacing an annotation always adds the prefix
+	assert.NoError(t, annotate(cfg, logger.NewBuffer(), ioutil.Discard))
+	assert.NoError(t, annotate(cfg, logger.NewBuffer(), ioutil.Discard))
+	assert.Equal(t, "**Team Llama**\n\nAll tests passed", bodies["tests"])
+
+	// Appending only adds it the first time the job appends to the context
+	cfg.Context = "progress"
+	cfg.Append = true
+	cfg.Body = "Building."
+	assert.NoError(t, annotate(cfg, logger.NewBuffer(), ioutil.Discard))
+	cfg.Body = " Done!"
+	assert.NoError(t, annotate(cfg, logger.NewBuffer(), ioutil.Discard))
+	assert.Equal(t, "**Team Llama**\n\nBuilding. Done!", bodies["progress"])
+
+	// Or after the job has replaced it with the prefix
+	cfg.Context = "tests"
+	cfg.Body = " Deployed!"
+	assert.NoError(t, annotate(cfg, logger.NewBuffer(), ioutil.Discard))
+	assert.Equal(t, "**Team Llama**\n\nAll tests passed Deployed!", bodies["tests"])
+
+	// Appending to a context that has to exist never adds it
+	cfg.Append = false
+	cfg.Context = ""
+	cfg.AppendTo = "other"
+	cfg.Body = "Deployed!"
+	assert.NoError(t, annotate(cfg, logger.NewBuffer(), ioutil.Discard))
+	assert.Equal(t, "Deployed!", bodies["other"])
+}
+
+func TestAnnotateExec(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("The commands are shell scripts")
+	}
+
+	var annotations []api.Annotation
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		var annotation api.Annotation
+		json.NewDecoder(req.Body).Decode(&annotation)
+		annotations = append(annotations, annotation)
+		rw.WriteHeader(http.StatusCreated)
+		fmt.Fprint(rw, `{}`)
+	}))
+	defer server.Close()
+
+	cfg := AnnotateConfig{
+		Exec:             true,
+		Job:              "job",
+		AgentAccessToken: "llamas",
+		Endpoint:         server.URL,
+	}
+
+	cfg.ExecArgs = []string{"sh", "-c", "echo 'All tests passed'"}
+	assert.NoError(t, annotate(cfg, logger.NewBuffer(), ioutil.Discard))
+
+	// The command failing doesn't fail annotating, and STDERR is logged
+	l := logger.NewBuffer()
+	cfg.ExecArgs = []string{"sh", "-c", "echo '3 tests failed'; echo 'llamas.rb:12' >&2; exit 3"}
+	assert.NoError(t, annotate(cfg, l, ioutil.Discard))
+	assert.Contains(t, l.Messages, "[info] sh wrote to STDERR:\nllamas.rb:12")
+	assert.Contains(t, l.Messages, "[info] sh exited with status 3")
+
+	// A given style takes precedence
+	cfg.Style = "warning"
+	assert.NoError(t, annotate(cfg, logger.NewBuffer(), ioutil.Discard))
+
+	if assert.Len(t, annotations, 3) {
+		assert.Equal(t, "All tests passed\n", annotations[0].Body)
+		assert.Equal(t, "success", annotations[0].Style)
+		assert.Equal(t, "3 tests failed\n", annotations[1].Body)
+		assert.Equal(t, "error", annotations[1].Style)
+		assert.Equal(t, "warning", annotations[2].Style)
+	}
+
+	// Commands that can't be run are an error
+	dir, err := ioutil.TempDir("", "annotate-exec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg.ExecArgs = []string{filepath.Join(dir, "missing")}
+	assert.Error(t, annotate(cfg, logger.NewBuffer(), ioutil.Discard))
+
+	cfg.ExecArgs = nil
+	assert.EqualError(t, annotate(cfg, logger.NewBuffer(), ioutil.Discard), "--exec requires a command to run, like --exec -- make test")
+}
+
+func TestRunAnnotationCommandLimitsOutput(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("The command is a shell script")
+	}
+
+	l := logger.NewBuffer()
+	body, style, err := runAnnotationCommand(l, []string{"sh", "-c", "echo 0123456789"}, 4, time.Time{})
+	assert.NoError(t, err)
+	assert.Equal(t, "0123", body)
+	assert.Equal(t, "success", style)
+	assert.Contains(t, l.Messages, "[warn] Only the first 4 bytes of the output of sh were kept for the annotation body")
+}
+
+func TestRunAnnotationCommandStopsAtDeadline(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("The command is a unix command")
+	}
+
+	l := logger.NewBuffer()
+	start := time.Now()
+	_, _, err := runAnnotationCommand(l, []string{"sleep", "10"}, 4, time.Now().Add(100*time.Millisecond))
+	assert.EqualError(t, err, "sleep didn't finish before the deadline")
+	assert.True(t, time.Since(start) < 5*time.Second, "Expected the command to be killed at the deadline")
+
+	// Only the command is logged, not its arguments
+	assert.Contains(t, l.Messages, "[info] Running sleep for the annotation body")
+}
+
+func TestAnnotateWritesStatusFile(t *testing.T) {
+	status := http.StatusCreated
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(status)
+		fmt.Fprint(rw, `{}`)
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "annotate-status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := AnnotateConfig{
+		Body:             "All tests passed",
+		StatusFile:       filepath.Join(dir, "status"),
+		Job:              "job",
+		AgentAccessToken: "llamas",
+		Endpoint:         server.URL,
+	}
+
+	readStatus := func() string {
+		t.Helper()
+		b, err := ioutil.ReadFile(cfg.StatusFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+
+	assert.NoError(t, annotate(cfg, logger.NewBuffer(), ioutil.Discard))
+	assert.Equal(t, "201\n", readStatus())
+
+	status = http.StatusBadRequest
+	assert.Error(t, annotate(cfg, logger.NewBuffer(), ioutil.Discard))
+	assert.Equal(t, "400\n", readStatus())
+
+	// The API can't be reached once the server is closed
+	server.Close()
+	cfg.Deadline = "1ms"
+	assert.Error(t, annotate(cfg, logger.NewBuffer(), ioutil.Discard))
+	assert.Equal(t, "0\n", readStatus())
+}
+
+func TestAnnotateDryRunDoesntRecordState(t *testing.T) {
+	var bodies []string
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		var annotation api.Annotation
+		json.NewDecoder(req.Body).Decode(&annotation)
+		bodies = append(bodies, annotation.Body)
+		rw.WriteHeader(http.StatusCreated)
+		fmt.Fprint(rw, `{}`)
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "annotate-dry-run")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := AnnotateConfig{
+		Body:             "3 tests failed",
+		Context:          "junit",
+		Prefix:           "## Tests",
+		Append:           true,
+		OncePerStep:      true,
+		MaxAppendSize:    100,
+		StatusFile:       filepath.Join(dir, "status"),
+		StateDir:         dir,
+		DryRun:           true,
+		Job:              "dry-run-test-job",
+		AgentAccessToken: "llamas",
+		Endpoint:         server.URL,
+	}
+
+	l := logger.NewBuffer()
+
+	// Nothing is sent or written by a dry run
+	assert.NoError(t, annotate(cfg, l, ioutil.Discard))
+	assert.Empty(t, bodies)
+
+	files, err := ioutil.ReadDir(dir)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Empty(t, files)
+
+	// So a real run afterwards still posts the annotation with its prefix
+	cfg.DryRun = false
+	assert.NoError(t, annotate(cfg, l, ioutil.Discard))
+	assert.Equal(t, []string{"## Tests\n\n3 tests failed"}, bodies)
+
+	b, err := ioutil.ReadFile(cfg.StatusFile)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "201\n", string(b))
+	}
+
+	// And it's what's recorded as posted once per step
+	assert.NoError(t, annotate(cfg, l, ioutil.Discard))
+	assert.Len(t, bodies, 1)
+}
+
+func TestAnnotationTransforms(t *testing.T) {
+	for _, tc := range []struct {
+		transform string
+		input     string
+		expected  string
+	}{
+		{"trim", "\n\n  ## Results  \n\n", "## Results"},
+		{"trim", "", ""},
+		{"dedent", "    ## Results\n\n      - 3 failed\n    Done", "## Results\n\n  - 3 failed\nDone"},
+		{"dedent", "\t- one\n\t\t- two\n", "- one\n\t- two\n"},
+		{"dedent", "  indented\nnot indented", "  indented\nnot indented"},
+		{"dedent", "  spaces\n\ttab", "  spaces\n\ttab"},
+		{"collapse-blanks", "one\n\n\n\ntwo\n  \n\t\nthree", "one\n\ntwo\n\nthree"},
+		{"collapse-blanks", "one\ntwo\n", "one\ntwo\n"},
+	} {
+		assert.Equal(t, tc.expected, annotationTransforms[tc.transform](tc.input), "%s %q", tc.transform, tc.input)
+	}
+}
+
+func TestAnnotateAppliesTransformsInOrder(t *testing.T) {
+	var bodies []string
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		var annotation api.Annotation
+		json.NewDecoder(req.Body).Decode(&annotation)
+		bodies = append(bodies, annotation.Body)
+		rw.WriteHeader(http.StatusCreated)
+		fmt.Fprint(rw, `{}`)
+	}))
+	defer server.Close()
+
+	cfg := AnnotateConfig{
+		Body:             "\n    ## Results\n\n\n      - 3 failed\n\n",
+		Transforms:       []string{"dedent", "collapse-blanks", "trim"},
+		Job:              "job",
+		AgentAccessToken: "llamas",
+		Endpoint:         server.URL,
+	}
+
+	assert.NoError(t, annotate(cfg, logger.NewBuffer(), ioutil.Discard))
+
+	// Trimming first leaves the first line's indentation out of the dedent
+	cfg.Transforms = []string{"trim", "dedent"}
+	assert.NoError(t, annotate(cfg, logger.NewBuffer(), ioutil.Discard))
+
+	assert.Equal(t, []string{"## Results\n\n  - 3 failed", "## Results\n\n\n      - 3 failed"}, bodies)
+
+	cfg.Transforms = []string{"llamas"}
+	assert.EqualError(t, annotate(cfg, logger.NewBuffer(), ioutil.Discard), `Unknown --transform "llamas", expected trim, dedent or collapse-blanks`)
+}
+
+func TestAnnotatePrintsBody(t *testing.T) {
+	var sent string
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		var annotation api.Annotation
+		json.NewDecoder(req.Body).Decode(&annotation)
+		sent = annotation.Body
+		rw.WriteHeader(http.StatusCreated)
+		fmt.Fprint(rw, `{}`)
+	}))
+	defer server.Close()
+
+	cfg := AnnotateConfig{
+		Body:             "  <b>3 tests</b> failed\n",
+		Transforms:       []string{"trim"},
+		Escape:           "html",
+		PrintBody:        true,
+		Job:              "job",
+		AgentAccessToken: "llamas",
+		Endpoint:         server.URL,
+	}
+
+	l := logger.NewBuffer()
+	assert.NoError(t, annotate(cfg, l, ioutil.Discard))
+	assert.Equal(t, "&lt;b&gt;3 tests&lt;/b&gt; failed", sent)
+	assert.Contains(t, l.Messages, "[info] Annotating with the body:\n"+sent)
+}
+
+func TestAnnotateInputJSON(t *testing.T) {
+	var sent []api.Annotation
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		var annotation api.Annotation
+		json.NewDecoder(req.Body).Decode(&annotation)
+		sent = append(sent, annotation)
+		rw.WriteHeader(http.StatusCreated)
+		fmt.Fprint(rw, `{}`)
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "annotate-input-json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	annotateWithJSON := func(input string, cfg AnnotateConfig) error {
+		t.Helper()
+		path := filepath.Join(dir, "annotation.json")
+		if err := ioutil.WriteFile(path, []byte(input), 0600); err != nil {
+			t.Fatal(err)
+		}
+		cfg.File = path
+		cfg.InputJSON = true
+		cfg.Job = "job"
+		cfg.AgentAccessToken = "llamas"
+		cfg.Endpoint = server.URL
+		return annotate(cfg, logger.NewBuffer(), ioutil.Discard)
+	}
+
+	// A full blob
+	assert.NoError(t, annotateWithJSON(`{"body":"3 tests failed","style":"error","context":"junit"}`, AnnotateConfig{}))
+
+	// Flags take precedence over the blob
+	assert.NoError(t, annotateWithJSON(`{"body":"3 tests failed","style":"error","context":"junit"}`, AnnotateConfig{Style: "warning", Context: "flaky"}))
+
+	// A partial blob
+	assert.NoError(t, annotateWithJSON(`{"body":"All tests passed"}`, AnnotateConfig{Style: "success"}))
+
+	assert.Equal(t, []api.Annotation{
+		{Body: "3 tests failed", Style: "error", Context: "junit"},
+		{Body: "3 tests failed", Style: "warning", Context: "flaky"},
+		{Body: "All tests passed", Style: "success"},
+	}, sent)
+
+	for input, expected := range map[string]string{
+		`["3 tests failed"]`:            "Failed to parse the annotation JSON: expected an object with body, style and context fields",
+		`null`:                          "Failed to parse the annotation JSON: expected an object with body, style and context fields",
+		`{"body":"3 tests failed"`:      "Failed to parse the annotation JSON: unexpected EOF",
+		`{"body":3}`:                    "Failed to parse the annotation JSON: json: cannot unmarshal number into Go struct field annotationInput.body of type string",
+		`{"bodies":"3 tests failed"}`:   `Failed to parse the annotation JSON: json: unknown field "bodies"`,
+		`{"body":"one"} {"body":"two"}`: "Failed to parse the annotation JSON: expected a single object",
+		"  \n":                          "--input-json requires a JSON object from --file or STDIN",
+	} {
+		assert.EqualError(t, annotateWithJSON(input, AnnotateConfig{}), expected, input)
+	}
+
+	assert.Len(t, sent, 3)
+}
+
+func TestAnnotateContentType(t *testing.T) {
+	var contentTypes []string
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		contentTypes = append(contentTypes, req.Header.Get("Content-Type"))
+		rw.WriteHeader(http.StatusCreated)
+		fmt.Fprint(rw, `{}`)
+	}))
+	defer server.Close()
+
+	cfg := AnnotateConfig{
+		Body:             "All tests passed",
+		Job:              "job",
+		AgentAccessToken: "llamas",
+		Endpoint:         server.URL,
+	}
+
+	assert.NoError(t, annotate(cfg, logger.NewBuffer(), ioutil.Discard))
+
+	cfg.ContentType = "application/vnd.buildkite.annotation+json; charset=utf-8"
+	assert.NoError(t, annotate(cfg, logger.NewBuffer(), ioutil.Discard))
+
+	assert.Equal(t, []string{"application/json", "application/vnd.buildkite.annotation+json; charset=utf-8"}, contentTypes)
+
+	for _, contentType := range []string{"json", "application/json; charset", "text/plain;;"} {
+		cfg.ContentType = contentType
+		assert.EqualError(t, annotate(cfg, logger.NewBuffer(), ioutil.Discard), fmt.Sprintf("Invalid --content-type %q, expected a MIME type like application/json", contentType))
+	}
+}
+
+func TestSanitizeAnnotationContext(t *testing.T) {
+	for context, expected := range map[string]string{
+		"junit":                "junit",
+		"team-a/unit_tests.go": "team-a/unit_tests.go",
+		"unit tests (linux)":   "unit-tests-linux",
+		"coverage: 87%":        "coverage:-87",
+		"--- llamas ---":       "llamas",
+		"🦙":                    "",
+	} {
+		assert.Equal(t, expected, sanitizeAnnotationContext(context), context)
+	}
+}
+
+func TestAnnotateSanitizeContextModes(t *testing.T) {
+	var contexts []string
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		var annotation api.Annotation
+		json.NewDecoder(req.Body).Decode(&annotation)
+		contexts = append(contexts, annotation.Context)
+		rw.WriteHeader(http.StatusCreated)
+		fmt.Fprint(rw, `{}`)
+	}))
+	defer server.Close()
+
+	cfg := AnnotateConfig{
+		Body:             "All tests passed",
+		Context:          "unit tests (linux)",
+		Sanitize:         "replace",
+		Job:              "job",
+		AgentAccessToken: "llamas",
+		Endpoint:         server.URL,
+	}
+
+	l := logger.NewBuffer()
+	assert.NoError(t, annotate(cfg, l, ioutil.Discard))
+	assert.Equal(t, []string{"unit-tests-linux"}, contexts)
+	assert.Contains(t, l.Messages, `[info] Replaced characters that aren't allowed in the annotation context "unit tests (linux)", using "unit-tests-linux"`)
+
+	cfg.Sanitize = "reject"
+	err := annotate(cfg, l, ioutil.Discard)
+	assert.EqualError(t, err, `The annotation context "unit tests (linux)" contains characters that aren't allowed, it can only contain letters, numbers and - _ . : /`)
+
+	// Allowed contexts are fine either way
+	cfg.Context = "unit-tests"
+	assert.NoError(t, annotate(cfg, l, ioutil.Discard))
+	assert.Equal(t, []string{"unit-tests-linux", "unit-tests"}, contexts)
+
+	cfg.Sanitize = "ignore"
+	err = annotate(cfg, l, ioutil.Discard)
+	assert.EqualError(t, err, `Unknown --sanitize-context "ignore", expected replace or reject`)
+}
@@ -1,10 +1,10 @@
 package clicommand
 
 import (
-  "time"
+  "fmt"
 
   "github.com/buildkite/agent/v3/api"
-  "github.com/buildkite/agent/v3/cliconfig"
+  "github.com/buildkite/agent/v3/logger"
   "github.com/buildkite/agent/v3/retry"
   "github.com/urfave/cli"
 )
@@ -26,20 +26,27 @@ Example:
    $ buildkite-agent annotation remove --context "remove-me"`
 
 type AnnotationRemoveConfig struct {
-  Context string `cli:"context" validate:"required"`
-  Job     string `cli:"job" validate:"required"`
+  Context    string `cli:"context" validate:"required"`
+  Job        string `cli:"job" validate:"required"`
+  StatusFile string `cli:"status-file" normalize:"filepath"`
 
   // Global flags
   Debug   bool         `cli:"debug"`
   NoColor bool         `cli:"no-color"`
+  Color   string       `cli:"color"`
   Experiments []string `cli:"experiment" normalize:"list"`
   Profile string       `cli:"profile"`
+  DumpConfig bool      `cli:"dump-config"`
 
   // API config
-  DebugHTTP        bool   `cli:"debug-http"`
-  AgentAccessToken string `cli:"agent-access-token" validate:"required"`
-  Endpoint         string `cli:"endpoint" validate:"required"`
-  NoHTTP2          bool   `cli:"no-http2"`
+  DebugHTTP          bool   `cli:"debug-http"`
+  AgentAccessToken   string `cli:"agent-access-token"`
+  TokenFromKeyring   string `cli:"token-from-keyring"`
+  Endpoint           string `cli:"endpoint" validate:"required"`
+  EndpointPathPrefix string `cli:"endpoint-path-prefix"`
+  NoHTTP2            bool   `cli:"no-http2"`
+  ConnectTimeout     string `cli:"connect-timeout"`
+  DryRun             bool   `cli:"dry-run"`
 }
 
 var AnnotationRemoveCommand = cli.Command{
@@ -62,60 +69,57 @@ var AnnotationRemoveCommand = cli.Command{
 
     // API Flags
     AgentAccessTokenFlag,
+    TokenFromKeyringFlag,
     EndpointFlag,
+    EndpointPathPrefixFlag,
     NoHTTP2Flag,
+    ConnectTimeoutFlag,
     DebugHTTPFlag,
+    DryRunFlag,
+    StatusFileFlag,
 
     // Global flags
     NoColorFlag,
+    ColorFlag,
     DebugFlag,
     ExperimentsFlag,
     ProfileFlag,
+    DumpConfigFlag,
   },
   Action: func(c *cli.Context) {
     // The configuration will be loaded into this struct
     cfg := AnnotationRemoveConfig{}
 
-    l := CreateLogger(&cfg)
-
-    // Load the configuration
-    if err := cliconfig.Load(c, l, &cfg); err != nil {
-      l.Fatal("%s", err)
-    }
-
-    // Setup any global configuration options
-    done := HandleGlobalFlags(l, cfg)
-    defer done()
-
-    var err error
-
-    // Create the API client
-    client := api.NewClient(l, loadAPIClientConfig(cfg, `AgentAccessToken`))
-
-    // Retry the removal a few times before giving up
-    err = retry.Do(func(s *retry.Stats) error {
-      // Attempt to remove the annotation
-      resp, err := client.AnnotationRemove(cfg.Job, cfg.Context)
-
-      // Don't bother retrying if the response was one of these statuses
-      if resp != nil && (resp.StatusCode == 401 || resp.StatusCode == 404 || resp.StatusCode == 400) {
-        s.Break()
+    runAPICommand(c, &cfg, func(l logger.Logger) error {
+      // Create the API client
+      client, err := newAPIClient(l, cfg, "annotation remove")
+      if err != nil {
         return err
       }
 
-      // Show the unexpected error
-      if err != nil {
-        l.Warn("%s (%s)", err, s)
+      // Retry the removal a few times before giving up
+      var resp *api.Response
+      err = retryAPIRequest(l, apiRetryOptions{}, func(s *retry.Stats) (*api.Response, error) {
+        // Attempt to remove the annotation
+        var err error
+        resp, err = client.WithAttempt(s.Attempt).AnnotationRemove(cfg.Job, cfg.Context)
+        return resp, err
+      })
+
+      if cfg.StatusFile != "" {
+        if statusErr := writeStatusFile(cfg.StatusFile, resp); statusErr != nil && err == nil {
+          return fmt.Errorf("Failed to write status to %s: %s", cfg.StatusFile, statusErr)
+        }
       }
 
-      return err
-    }, &retry.Config{Maximum: 5, Interval: 1 * time.Second, Jitter: true})
+      // Show a fatal error if we gave up trying to remove the annotation
+      if err != nil {
+        return fmt.Errorf("Failed to remove annotation: %s", err)
+      }
 
-    // Show a fatal error if we gave up trying to create the annotation
-    if err != nil {
-      l.Fatal("Failed to remove annotation: %s", err)
-    }
+      l.Debug("Successfully removed annotation")
 
-    l.Debug("Successfully removed annotation")
+      return nil
+    })
   },
 }
@@ -0,0 +1,216 @@
+package clicommand
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"reflect"
+	"time"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/cliconfig"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/buildkite/agent/v3/retry"
+	"github.com/oleiade/reflections"
+	"github.com/urfave/cli"
+)
+
+// runAPICommand does the setup shared by commands that talk to the Agent API.
+// It loads the configuration into cfg (which must be a pointer to the
+// command's config struct), creates the logger and handles the global flags,
+// and then calls fn. An error returned by fn is fatal. With --dump-config, the
+// configuration is printed instead of calling fn.
+func runAPICommand(c *cli.Context, cfg interface{}, fn func(l logger.Logger) error) {
+	l := CreateLogger(cfg)
+
+	// Load the configuration
+	if err := cliconfig.Load(c, l, cfg); err != nil {
+		l.Fatal("%s", err)
+	}
+
+	if dump, err := reflections.GetField(cfg, "DumpConfig"); dump == true && err == nil {
+		w := c.App.Writer
+		if w == nil {
+			w = os.Stdout
+		}
+		if err := dumpConfig(w, cfg); err != nil {
+			l.Fatal("Failed to print the configuration: %s", err)
+		}
+		return
+	}
+
+	// Setup any global configuration options
+	done := HandleGlobalFlags(l, cfg)
+	defer done()
+
+	if err := fn(l); err != nil {
+		l.Fatal("%s", err)
+	}
+}
+
+// Config fields that are redacted when the configuration is printed
+var redactedConfigFields = map[string]bool{
+	"AgentAccessToken": true,
+	"Token":            true,
+}
+
+// dumpConfig prints the configuration as JSON, keyed by the name of each
+// field's flag (or its label for arguments), with tokens and any credentials
+// in the endpoint redacted
+func dumpConfig(w io.Writer, cfg interface{}) error {
+	v := reflect.Indirect(reflect.ValueOf(cfg))
+	t := v.Type()
+
+	dump := map[string]interface{}{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+
+		name := field.Tag.Get("cli")
+		if name == "" {
+			continue
+		}
+		if label := field.Tag.Get("label"); label != "" {
+			name = label
+		}
+
+		value := v.Field(i).Interface()
+		switch {
+		case redactedConfigFields[field.Name] && value != "":
+			value = "[REDACTED]"
+		case field.Name == "Endpoint":
+			if u, err := url.Parse(value.(string)); err == nil && u.User != nil {
+				u.User = url.User("REDACTED")
+				value = u.String()
+			}
+		}
+
+		dump[name] = value
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(dump)
+}
+
+// newAPIClient creates an API client from the command's API config, which
+// must include an agent access token, either as a flag or in the keyring
+func newAPIClient(l logger.Logger, cfg interface{}, command string) (*api.Client, error) {
+	conf := loadAPIClientConfig(cfg, `AgentAccessToken`)
+	applyKeyringToken(l, keyring, cfg, &conf)
+	if conf.Token == "" {
+		return nil, fmt.Errorf("Missing agent-access-token. See: `buildkite-agent %s --help`", command)
+	}
+
+	timeout, err := connectTimeout(cfg)
+	if err != nil {
+		return nil, err
+	}
+	conf.ConnectTimeout = timeout
+
+	return api.NewClient(l, conf), nil
+}
+
+// applyKeyringToken uses the token from the keyring if --token-from-keyring is
+// given, which takes precedence over --agent-access-token. If it can't be read
+// the reason is logged, and the token from the flag is used.
+func applyKeyringToken(l logger.Logger, kr Keyring, cfg interface{}, conf *api.Config) {
+	token, err := tokenFromKeyring(kr, cfg)
+	if err != nil {
+		l.Warn("Couldn't read the agent access token from the keyring: %v", err)
+		return
+	}
+	if token != "" {
+		conf.Token = token
+	}
+}
+
+// writeStatusFile writes the HTTP status of a response to a file for scripts
+// to read, which is 0 if there's no response because the request failed
+// before the API could respond
+func writeStatusFile(path string, resp *api.Response) error {
+	status := 0
+	if resp != nil {
+		status = resp.StatusCode
+	}
+
+	return ioutil.WriteFile(path, []byte(fmt.Sprintf("%d\n", status)), 0644)
+}
+
+// maxAPIRetryAfter is the longest we'll wait between attempts when a rate
+// limited response asks us to wait longer
+const maxAPIRetryAfter = 60 * time.Second
+
+// apiRetryOptions changes how retryAPIRequest retries a request
+type apiRetryOptions struct {
+	// Don't retry requests that fail, unless they were rate limited, which
+	// is for requests that could be applied twice
+	SingleAttempt bool
+
+	// Give up rather than start an attempt after this time
+	Deadline time.Time
+
+	// The longest a Retry-After header can make us wait between attempts,
+	// which defaults to maxAPIRetryAfter
+	MaxRetryAfter time.Duration
+}
+
+// retryAPIRequest makes a request a few times before giving up. Requests that
+// fail with a status that won't change aren't retried, and requests that are
+// rate limited are retried after as long as the API asked for.
+func retryAPIRequest(l logger.Logger, opts apiRetryOptions, fn func(s *retry.Stats) (*api.Response, error)) error {
+	if opts.MaxRetryAfter == 0 {
+		opts.MaxRetryAfter = maxAPIRetryAfter
+	}
+
+	return retry.Do(func(s *retry.Stats) error {
+		resp, err := fn(s)
+		if err == nil {
+			return nil
+		}
+
+		// Retrying won't help if the endpoint's host doesn't exist
+		if api.IsPermanentNetworkError(err) {
+			s.Break()
+			return fmt.Errorf("%s (the Agent API endpoint's host couldn't be found, check --endpoint)", err)
+		}
+
+		// Don't bother retrying if the response was one of these statuses
+		if resp != nil && (resp.StatusCode == 401 || resp.StatusCode == 404 || resp.StatusCode == 400) {
+			s.Break()
+			return err
+		}
+
+		// Back off for as long as we're asked to when rate limited. The
+		// request wasn't applied, so it's always safe to retry. A server
+		// asking for an unreasonably long wait is capped.
+		if retryAfter, ok := resp.RetryAfter(); ok {
+			if retryAfter > opts.MaxRetryAfter {
+				retryAfter = opts.MaxRetryAfter
+			}
+			s.Interval = retryAfter
+		} else if opts.SingleAttempt {
+			s.Break()
+			return err
+		}
+
+		// There's no point waiting after the last attempt
+		if !s.Config.Forever && s.Attempt >= s.Config.Maximum {
+			s.Break()
+			return err
+		}
+
+		// Give up rather than retry past the deadline
+		if !opts.Deadline.IsZero() && time.Now().Add(s.Interval).After(opts.Deadline) {
+			s.Break()
+			return fmt.Errorf("%s (giving up as the next attempt would be past the deadline)", err)
+		}
+
+		// Show the unexpected error
+		l.Warn("%s (%s)", err, s)
+
+		return err
+	}, &retry.Config{Maximum: 5, Interval: 1 * time.Second, Jitter: true})
+}
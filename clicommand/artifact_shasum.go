@@ -45,14 +45,16 @@ type ArtifactShasumConfig struct {
 	// Global flags
 	Debug       bool     `cli:"debug"`
 	NoColor     bool     `cli:"no-color"`
+	Color       string   `cli:"color"`
 	Experiments []string `cli:"experiment" normalize:"list"`
 	Profile     string   `cli:"profile"`
 
 	// API config
-	DebugHTTP        bool   `cli:"debug-http"`
-	AgentAccessToken string `cli:"agent-access-token" validate:"required"`
-	Endpoint         string `cli:"endpoint" validate:"required"`
-	NoHTTP2          bool   `cli:"no-http2"`
+	DebugHTTP          bool   `cli:"debug-http"`
+	AgentAccessToken   string `cli:"agent-access-token" validate:"required"`
+	Endpoint           string `cli:"endpoint" validate:"required"`
+	EndpointPathPrefix string `cli:"endpoint-path-prefix"`
+	NoHTTP2            bool   `cli:"no-http2"`
 }
 
 var ArtifactShasumCommand = cli.Command{
@@ -80,11 +82,13 @@ var ArtifactShasumCommand = cli.Command{
 		// API Flags
 		AgentAccessTokenFlag,
 		EndpointFlag,
+		EndpointPathPrefixFlag,
 		NoHTTP2Flag,
 		DebugHTTPFlag,
 
 		// Global flags
 		NoColorFlag,
+		ColorFlag,
 		DebugFlag,
 		ExperimentsFlag,
 		ProfileFlag,
@@ -6,6 +6,7 @@ import (
 	"os"
 	"reflect"
 	"strings"
+	"time"
 
 	"github.com/buildkite/agent/v3/agent"
 	"github.com/buildkite/agent/v3/api"
@@ -26,6 +27,13 @@ var AgentAccessTokenFlag = cli.StringFlag{
 	EnvVar: "BUILDKITE_AGENT_ACCESS_TOKEN",
 }
 
+var TokenFromKeyringFlag = cli.StringFlag{
+	Name:   "token-from-keyring",
+	Value:  "",
+	Usage:  "Read the agent access token from the operating system's keyring entry for this service (with the account buildkite-agent), falling back to --agent-access-token. Uses the Windows Credential Manager, the macOS Keychain, or secret-tool elsewhere",
+	EnvVar: "BUILDKITE_AGENT_TOKEN_FROM_KEYRING",
+}
+
 var AgentRegisterTokenFlag = cli.StringFlag{
 	Name:   "token",
 	Value:  "",
@@ -40,12 +48,44 @@ var EndpointFlag = cli.StringFlag{
 	EnvVar: "BUILDKITE_AGENT_ENDPOINT",
 }
 
+var EndpointPathPrefixFlag = cli.StringFlag{
+	Name:   "endpoint-path-prefix",
+	Value:  "",
+	Usage:  "A path added to the start of the path of every request to the Agent API, for when it's behind a reverse proxy that serves it under a path",
+	EnvVar: "BUILDKITE_AGENT_ENDPOINT_PATH_PREFIX",
+}
+
 var NoHTTP2Flag = cli.BoolFlag{
 	Name:   "no-http2",
 	Usage:  "Disable HTTP2 when communicating with the Agent API.",
 	EnvVar: "BUILDKITE_NO_HTTP2",
 }
 
+var ConnectTimeoutFlag = cli.StringFlag{
+	Name:   "connect-timeout",
+	Value:  "30s",
+	Usage:  "How long to wait for a connection to the Agent API to be established, including the TLS handshake, such as 10s",
+	EnvVar: "BUILDKITE_AGENT_CONNECT_TIMEOUT",
+}
+
+var DryRunFlag = cli.BoolFlag{
+	Name:   "dry-run",
+	Usage:  "Log the changes that would be made through the Agent API instead of making them. Supported by annotate and annotation remove",
+	EnvVar: "BUILDKITE_AGENT_DRY_RUN",
+}
+
+var StatusFileFlag = cli.StringFlag{
+	Name:   "status-file",
+	Usage:  "Write the HTTP status of the Agent API request to this file once it's finished, whether it succeeded or not, or 0 if the API couldn't be reached",
+	EnvVar: "BUILDKITE_AGENT_STATUS_FILE",
+}
+
+var DumpConfigFlag = cli.BoolFlag{
+	Name:   "dump-config",
+	Usage:  "Print the configuration the command would run with as JSON, after flags, environment variables and defaults have been applied, and exit without running it. Tokens and credentials are redacted",
+	EnvVar: "BUILDKITE_AGENT_DUMP_CONFIG",
+}
+
 var DebugFlag = cli.BoolFlag{
 	Name:   "debug",
 	Usage:  "Enable debug mode",
@@ -70,6 +110,12 @@ var NoColorFlag = cli.BoolFlag{
 	EnvVar: "BUILDKITE_AGENT_NO_COLOR",
 }
 
+var ColorFlag = cli.StringFlag{
+	Name:   "color",
+	Usage:  "When to show colors in logging, either `always`, `never` or `auto`, which only shows them when logging to a terminal. Defaults to always, and --no-color is the same as never",
+	EnvVar: "BUILDKITE_AGENT_COLOR",
+}
+
 var ExperimentsFlag = cli.StringSliceFlag{
 	Name:   "experiment",
 	Value:  &cli.StringSlice{},
@@ -103,13 +149,13 @@ func CreateLogger(cfg interface{}) logger.Logger {
 			}
 		}
 
-		// Turn off color if a NoColor option is present
-		noColor, err := reflections.GetField(cfg, "NoColor")
-		if noColor == true && err == nil {
-			printer.Colors = false
-		} else {
-			printer.Colors = true
+		// Work out whether to show colors from the Color and NoColor options
+		colors, err := loggerColors(cfg, stderrIsTerminal)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
 		}
+		printer.Colors = colors
 
 		l = logger.NewConsoleLogger(printer, os.Exit)
 	case `json`:
@@ -122,6 +168,38 @@ func CreateLogger(cfg interface{}) logger.Logger {
 	return l
 }
 
+// loggerColors returns whether the logger should show colors. NoColor is the
+// same as a Color of never, and without either colors are always shown.
+func loggerColors(cfg interface{}, isTerminal func() bool) (bool, error) {
+	noColor, err := reflections.GetField(cfg, "NoColor")
+	if noColor == true && err == nil {
+		return false, nil
+	}
+
+	color, _ := reflections.GetField(cfg, "Color")
+	mode, _ := color.(string)
+
+	switch mode {
+	case "", "always":
+		return true, nil
+	case "never":
+		return false, nil
+	case "auto":
+		return isTerminal(), nil
+	default:
+		return false, fmt.Errorf("Unknown color mode %q, try always, never or auto", mode)
+	}
+}
+
+// stderrIsTerminal returns whether the logger's output is a terminal
+func stderrIsTerminal() bool {
+	fi, err := os.Stderr.Stat()
+	if err != nil {
+		return false
+	}
+	return fi.Mode()&os.ModeCharDevice != 0
+}
+
 func HandleProfileFlag(l logger.Logger, cfg interface{}) func() {
 	// Enable profiling a profiling mode if Profile is present
 	modeField, _ := reflections.GetField(cfg, "Profile")
@@ -191,11 +269,21 @@ func loadAPIClientConfig(cfg interface{}, tokenField string) api.Config {
 		conf.Endpoint = endpoint.(string)
 	}
 
+	pathPrefix, err := reflections.GetField(cfg, "EndpointPathPrefix")
+	if s, ok := pathPrefix.(string); ok && err == nil {
+		conf.PathPrefix = s
+	}
+
 	token, err := reflections.GetField(cfg, tokenField)
 	if token != "" && err == nil {
 		conf.Token = token.(string)
 	}
 
+	dryRun, err := reflections.GetField(cfg, "DryRun")
+	if dryRun == true && err == nil {
+		conf.DryRun = true
+	}
+
 	noHTTP2, err := reflections.GetField(cfg, "NoHTTP2")
 	if err == nil {
 		conf.DisableHTTP2 = noHTTP2.(bool)
@@ -203,3 +291,34 @@ func loadAPIClientConfig(cfg interface{}, tokenField string) api.Config {
 
 	return conf
 }
+
+// connectTimeout parses the ConnectTimeout config field, and returns 0 for the
+// client's default if it isn't set
+func connectTimeout(cfg interface{}) (time.Duration, error) {
+	value, err := reflections.GetField(cfg, "ConnectTimeout")
+	s, ok := value.(string)
+	if err != nil || !ok || s == "" {
+		return 0, nil
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("Failed to parse connect timeout: %v", err)
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("Failed to parse connect timeout: %q is negative", s)
+	}
+
+	return d, nil
+}
+
+// tokenFromKeyring reads the token from the keyring if a TokenFromKeyring
+// service is configured, and returns "" if one isn't
+func tokenFromKeyring(kr Keyring, cfg interface{}) (string, error) {
+	service, err := reflections.GetField(cfg, "TokenFromKeyring")
+	if err != nil || service == "" {
+		return "", nil
+	}
+
+	return kr.Get(service.(string), KeyringUser)
+}
@@ -0,0 +1,52 @@
+package clicommand
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoggerColors(t *testing.T) {
+	type colorConfig struct {
+		NoColor bool   `cli:"no-color"`
+		Color   string `cli:"color"`
+	}
+
+	terminal := func() bool { return true }
+	notTerminal := func() bool { return false }
+
+	for _, tc := range []struct {
+		name       string
+		cfg        colorConfig
+		isTerminal func() bool
+		colors     bool
+	}{
+		{"default", colorConfig{}, notTerminal, true},
+		{"always", colorConfig{Color: "always"}, notTerminal, true},
+		{"never", colorConfig{Color: "never"}, terminal, false},
+		{"auto with a terminal", colorConfig{Color: "auto"}, terminal, true},
+		{"auto without a terminal", colorConfig{Color: "auto"}, notTerminal, false},
+		{"no-color", colorConfig{NoColor: true}, terminal, false},
+		{"no-color overrides always", colorConfig{NoColor: true, Color: "always"}, terminal, false},
+	} {
+		colors, err := loggerColors(tc.cfg, tc.isTerminal)
+		if assert.NoError(t, err, tc.name) {
+			assert.Equal(t, tc.colors, colors, tc.name)
+		}
+	}
+
+	_, err := loggerColors(colorConfig{Color: "sometimes"}, terminal)
+	assert.EqualError(t, err, `Unknown color mode "sometimes", try always, never or auto`)
+
+	// Configs without either option always show colors
+	colors, err := loggerColors(struct{}{}, notTerminal)
+	if assert.NoError(t, err) {
+		assert.True(t, colors)
+	}
+}
+
+func TestLoadAPIClientConfigPathPrefix(t *testing.T) {
+	conf := loadAPIClientConfig(AnnotateConfig{Endpoint: "https://proxy.internal", EndpointPathPrefix: "/buildkite/v3"}, `AgentAccessToken`)
+	assert.Equal(t, "https://proxy.internal", conf.Endpoint)
+	assert.Equal(t, "/buildkite/v3", conf.PathPrefix)
+}
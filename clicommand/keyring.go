@@ -0,0 +1,18 @@
+package clicommand
+
+// KeyringUser is the account name that tokens are stored under in the
+// operating system's keyring
+const KeyringUser = "buildkite-agent"
+
+// Keyring reads secrets from a credential store
+type Keyring interface {
+	Get(service, user string) (string, error)
+}
+
+// systemKeyring reads secrets from the operating system's keyring: the
+// Windows Credential Manager, the macOS Keychain via `security`, and the
+// Secret Service via `secret-tool` elsewhere
+type systemKeyring struct{}
+
+// The keyring used by newAPIClient
+var keyring Keyring = systemKeyring{}
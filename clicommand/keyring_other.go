@@ -0,0 +1,35 @@
+// +build !windows
+
+package clicommand
+
+import (
+	"fmt"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+func (systemKeyring) Get(service, user string) (string, error) {
+	var cmd *exec.Cmd
+
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("security", "find-generic-password", "-s", service, "-a", user, "-w")
+	case "linux", "freebsd", "openbsd", "netbsd":
+		cmd = exec.Command("secret-tool", "lookup", "service", service, "username", user)
+	default:
+		return "", fmt.Errorf("Reading from the keyring isn't supported on %s", runtime.GOOS)
+	}
+
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("Failed to read %q from the keyring: %v", service, err)
+	}
+
+	secret := strings.TrimRight(string(out), "\r\n")
+	if secret == "" {
+		return "", fmt.Errorf("No secret for %q found in the keyring", service)
+	}
+
+	return secret, nil
+}
@@ -0,0 +1,52 @@
+package clicommand
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeKeyring map[string]string
+
+func (f fakeKeyring) Get(service, user string) (string, error) {
+	if secret, ok := f[service+"/"+user]; ok {
+		return secret, nil
+	}
+	return "", errors.New("not found")
+}
+
+func TestApplyKeyringToken(t *testing.T) {
+	kr := fakeKeyring{"buildkite/buildkite-agent": "llamas"}
+
+	tokenFor := func(l logger.Logger, cfg AnnotateConfig) string {
+		conf := loadAPIClientConfig(cfg, `AgentAccessToken`)
+		applyKeyringToken(l, kr, cfg, &conf)
+		return conf.Token
+	}
+
+	// The keyring takes precedence over the flag
+	l := logger.NewBuffer()
+	assert.Equal(t, "llamas", tokenFor(l, AnnotateConfig{AgentAccessToken: "alpacas", TokenFromKeyring: "buildkite"}))
+	assert.Empty(t, l.Messages)
+
+	// A missing keyring entry falls back to the flag, and says why
+	assert.Equal(t, "alpacas", tokenFor(l, AnnotateConfig{AgentAccessToken: "alpacas", TokenFromKeyring: "missing"}))
+	assert.Equal(t, []string{"[warn] Couldn't read the agent access token from the keyring: not found"}, l.Messages)
+
+	// The keyring isn't consulted unless asked
+	l = logger.NewBuffer()
+	assert.Equal(t, "alpacas", tokenFor(l, AnnotateConfig{AgentAccessToken: "alpacas"}))
+	assert.Empty(t, l.Messages)
+}
+
+func TestNewAPIClientWarnsWhenKeyringFails(t *testing.T) {
+	defer func(kr Keyring) { keyring = kr }(keyring)
+	keyring = fakeKeyring{}
+
+	l := logger.NewBuffer()
+	_, err := newAPIClient(l, AnnotationRemoveConfig{TokenFromKeyring: "buildkite"}, "annotation remove")
+	assert.EqualError(t, err, "Missing agent-access-token. See: `buildkite-agent annotation remove --help`")
+	assert.Equal(t, []string{"[warn] Couldn't read the agent access token from the keyring: not found"}, l.Messages)
+}
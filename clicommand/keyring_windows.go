@@ -0,0 +1,87 @@
+// +build windows
+
+package clicommand
+
+import (
+	"fmt"
+	"syscall"
+	"unicode/utf16"
+	"unsafe"
+)
+
+var (
+	advapi32      = syscall.NewLazyDLL("advapi32.dll")
+	procCredReadW = advapi32.NewProc("CredReadW")
+	procCredFree  = advapi32.NewProc("CredFree")
+)
+
+// CRED_TYPE_GENERIC, the type of credentials added with cmdkey /generic
+const credTypeGeneric = 1
+
+// credential is a CREDENTIALW from wincred.h
+type credential struct {
+	Flags              uint32
+	Type               uint32
+	TargetName         *uint16
+	Comment            *uint16
+	LastWritten        syscall.Filetime
+	CredentialBlobSize uint32
+	CredentialBlob     *byte
+	Persist            uint32
+	AttributeCount     uint32
+	Attributes         uintptr
+	TargetAlias        *uint16
+	UserName           *uint16
+}
+
+// Get reads a generic credential from the Windows Credential Manager, where
+// the service is the credential's target and the user is its user name, such
+// as one added with cmdkey /generic:<service> /user:buildkite-agent
+func (systemKeyring) Get(service, user string) (string, error) {
+	target, err := syscall.UTF16PtrFromString(service)
+	if err != nil {
+		return "", err
+	}
+
+	var cred *credential
+	ok, _, err := procCredReadW.Call(uintptr(unsafe.Pointer(target)), credTypeGeneric, 0, uintptr(unsafe.Pointer(&cred)))
+	if ok == 0 {
+		return "", fmt.Errorf("Failed to read %q from the Windows Credential Manager: %v", service, err)
+	}
+	defer procCredFree.Call(uintptr(unsafe.Pointer(cred)))
+
+	if cred.UserName != nil {
+		if name := utf16PtrToString(cred.UserName); name != user {
+			return "", fmt.Errorf("The credential for %q in the Windows Credential Manager is for the user %q, not %q", service, name, user)
+		}
+	}
+
+	size := int(cred.CredentialBlobSize)
+	if size == 0 || cred.CredentialBlob == nil {
+		return "", fmt.Errorf("No secret for %q found in the Windows Credential Manager", service)
+	}
+	blob := (*[1 << 20]byte)(unsafe.Pointer(cred.CredentialBlob))[:size:size]
+
+	// Passwords saved with cmdkey or the Credential Manager are UTF-16
+	if size%2 != 0 {
+		return string(blob), nil
+	}
+	chars := make([]uint16, size/2)
+	for i := range chars {
+		chars[i] = uint16(blob[2*i]) | uint16(blob[2*i+1])<<8
+	}
+	return string(utf16.Decode(chars)), nil
+}
+
+// utf16PtrToString converts a NUL terminated UTF-16 string to a string
+func utf16PtrToString(p *uint16) string {
+	var chars []uint16
+	for ptr := unsafe.Pointer(p); ; ptr = unsafe.Pointer(uintptr(ptr) + 2) {
+		c := *(*uint16)(ptr)
+		if c == 0 {
+			break
+		}
+		chars = append(chars, c)
+	}
+	return string(utf16.Decode(chars))
+}
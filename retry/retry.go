@@ -8,7 +8,10 @@ import (
 )
 
 type Stats struct {
-	Attempt   int
+	Attempt int
+
+	// How long to wait before the next attempt, which the callback can
+	// change to override the configured interval
 	Interval  time.Duration
 	Config    *Config
 	breakNext bool